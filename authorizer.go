@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/httptest"
 	"strings"
 )
 
@@ -36,11 +35,13 @@ func NewAuthRequest(orgl *http.Request) (r *http.Request, req *Request, err erro
 
 	// generate the request
 	req = &Request{
-		Raw:    orgl,
-		Role:   RoleAuthorizer,
-		Params: make(map[string]string),
-		Stdin:  stdin,
-		Data:   nil,
+		Raw:   orgl,
+		Role:  RoleAuthorizer,
+		Stdin: stdin,
+		Data:  nil,
+
+		// reuse the connection by default
+		KeepConn: true,
 	}
 	return
 }
@@ -98,24 +99,29 @@ func (ar Authorizer) Wrap(inner http.Handler) http.Handler {
 		}
 
 		ew := new(bytes.Buffer)
-		rw := httptest.NewRecorder() // FIXME: should do this without httptest
-		if err = resp.WriteTo(rw, ew); err != nil {
-			log.Printf("cannot write to response pipe: %s", err)
+		authResp, err := resp.Response(ew)
+		var body []byte
+		if err == nil {
+			body, err = ioutil.ReadAll(authResp.Body)
+			authResp.Body.Close()
+		}
+		if err != nil {
+			log.Printf("cannot read the response pipe: %s", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprint(w, http.StatusText(http.StatusInternalServerError))
 			return
 		}
 
 		// if code is not http.StatusOK (200)
-		if rw.Code != http.StatusOK {
+		if authResp.StatusCode != http.StatusOK {
 			// copy header map
-			for k, m := range rw.Header() {
+			for k, m := range authResp.Header {
 				for _, v := range m {
 					w.Header().Add(k, v)
 				}
 			}
-			w.WriteHeader(rw.Code)
-			fmt.Fprint(w, rw.Body.String())
+			w.WriteHeader(authResp.StatusCode)
+			w.Write(body)
 
 			// if error stream is not empty
 			// also write to response
@@ -134,7 +140,7 @@ func (ar Authorizer) Wrap(inner http.Handler) http.Handler {
 		// no problem from authorizer
 		// pass down variable to the inner handler
 		// and discard the authorizer stdout and stderr
-		for k, m := range rw.Header() {
+		for k, m := range authResp.Header {
 			// looking for header with keys "Variable-*"
 			// strip the prefix and pass to the inner header
 			if len(k) > 9 && strings.HasPrefix(strings.ToLower(k), "variable-") {
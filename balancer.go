@@ -0,0 +1,448 @@
+package gofast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrNoBackend is returned by Balancer if there is no backend
+// to create a client from.
+var ErrNoBackend = errors.New("gofast: no backend available")
+
+// BalanceStrategy is the strategy of a Balancer to pick
+// a backend for each client.
+type BalanceStrategy int
+
+// Strategies of Balancer
+const (
+	// RoundRobin picks the backends in turn.
+	RoundRobin BalanceStrategy = iota
+
+	// WeightedRoundRobin picks the backends in turn, in
+	// proportion to their weights. The picks of backends are
+	// interleaved (like the weighted round-robin of nginx).
+	WeightedRoundRobin
+
+	// LeastOutstanding picks the backend with the least clients
+	// in use, relative to its weight.
+	LeastOutstanding
+
+	// ConsistentHash picks the backend by the hash key of the
+	// context (see WithHashKey) on a hash ring, so the same key
+	// goes to the same backend. Adding or removing a backend
+	// only moves the keys of that backend. Contexts without a
+	// hash key are picked in turn.
+	ConsistentHash
+)
+
+// String implements fmt.Stringer
+func (s BalanceStrategy) String() string {
+	switch s {
+	case RoundRobin:
+		return "round-robin"
+	case WeightedRoundRobin:
+		return "weighted-round-robin"
+	case LeastOutstanding:
+		return "least-outstanding"
+	case ConsistentHash:
+		return "consistent-hash"
+	}
+	return fmt.Sprintf("BalanceStrategy(%d)", int(s))
+}
+
+// hashKey is the context key of the hash key.
+type hashKey struct{}
+
+// WithHashKey returns a copy of ctx with the key for
+// ConsistentHash balancing (e.g. a session ID or the
+// client address).
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// HashKey returns the hash key of the context set by
+// WithHashKey, or an empty string if none.
+func HashKey(ctx context.Context) string {
+	key, _ := ctx.Value(hashKey{}).(string)
+	return key
+}
+
+// Backend is a FastCGI application served by a Balancer.
+type Backend struct {
+	// Name identifies the backend in the Balancer
+	// (e.g. the address).
+	Name string
+
+	// Weight of the backend for WeightedRoundRobin,
+	// LeastOutstanding and ConsistentHash. Defaults to 1.
+	Weight int
+
+	// Pool of clients to the backend. It is closed when the
+	// backend is removed from the Balancer.
+	Pool *ClientPool
+
+	// Limit, if not nil, limits the requests in flight to the
+	// backend with a Limiter in front of the Pool.
+	Limit *LimitConfig
+}
+
+// NewBackend returns a Backend of the given network address,
+// with a pool of the given config.
+func NewBackend(network, address string, weight int, config PoolConfig) Backend {
+	return Backend{
+		Name:   address,
+		Weight: weight,
+		Pool: NewPool(
+			SimpleContextClientFactory(SimpleContextConnFactory(network, address)),
+			config,
+		),
+	}
+}
+
+// backendState is the state of a Backend in a Balancer
+type backendState struct {
+	Backend
+
+	// number of clients in use
+	outstanding int
+
+	// limiter of the requests, or nil if not limited
+	limiter *Limiter
+
+	// current weight of the smooth weighted round-robin
+	current int
+
+	health backendHealth
+}
+
+// weight returns the effective weight of the backend
+func (b *backendState) weight() int {
+	if b.Weight <= 0 {
+		return 1
+	}
+	return b.Weight
+}
+
+// ringReplicas is the number of points of a backend, per weight,
+// on the hash ring of ConsistentHash.
+const ringReplicas = 100
+
+// ringPoint is a point of a backend on the hash ring
+type ringPoint struct {
+	hash    uint32
+	backend *backendState
+}
+
+// Balancer balances clients over multiple backends, each with its
+// own ClientPool. Backends can be added and removed at any time.
+type Balancer struct {
+	strategy BalanceStrategy
+
+	// mutex guards all the fields below
+	mutex       sync.Mutex
+	backends    []*backendState
+	ring        []ringPoint
+	next        int
+	healthCheck HealthCheck
+	stopChecker chan struct{}
+	checkerDone chan struct{}
+	closed      bool
+}
+
+// NewBalancer creates a Balancer of the given strategy,
+// with the given backends.
+func NewBalancer(strategy BalanceStrategy, backends ...Backend) (*Balancer, error) {
+	b := &Balancer{strategy: strategy}
+	for _, backend := range backends {
+		if err := b.Add(backend); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Add adds a backend to the Balancer. The name of the
+// backend should be unique.
+func (b *Balancer) Add(backend Backend) error {
+	if backend.Pool == nil {
+		return fmt.Errorf("gofast: backend %q has no pool", backend.Name)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return fmt.Errorf("gofast: balancer closed")
+	}
+	if b.find(backend.Name) >= 0 {
+		return fmt.Errorf("gofast: backend %q already exists", backend.Name)
+	}
+	state := &backendState{Backend: backend}
+	if backend.Limit != nil {
+		state.limiter = NewLimiter(backend.Pool.CreateClientContext, *backend.Limit)
+	}
+	b.backends = append(b.backends, state)
+	b.buildRing()
+	return nil
+}
+
+// Remove removes the backend of the given name and closes its pool.
+// Clients of the backend in use are closed when they are returned.
+// Returns false if there is no such backend.
+func (b *Balancer) Remove(name string) bool {
+	b.mutex.Lock()
+	i := b.find(name)
+	if i < 0 {
+		b.mutex.Unlock()
+		return false
+	}
+	removed := b.backends[i]
+	b.backends = append(b.backends[:i:i], b.backends[i+1:]...)
+	b.buildRing()
+	b.mutex.Unlock()
+
+	removed.Pool.Close()
+	return true
+}
+
+// Backends returns the backends of the Balancer.
+func (b *Balancer) Backends() []Backend {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	backends := make([]Backend, len(b.backends))
+	for i, backend := range b.backends {
+		backends[i] = backend.Backend
+	}
+	return backends
+}
+
+// LimitStats returns the statistics of the Limiter of the backend
+// of the given name. Returns false if there is no such backend, or
+// the backend is not limited.
+func (b *Balancer) LimitStats(name string) (stats LimitStats, ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if i := b.find(name); i >= 0 && b.backends[i].limiter != nil {
+		return b.backends[i].limiter.Stats(), true
+	}
+	return
+}
+
+// Close removes all backends and closes their pools.
+func (b *Balancer) Close() error {
+	b.mutex.Lock()
+	backends := b.backends
+	b.backends, b.ring, b.closed = nil, nil, true
+	stopped := b.stopHealthCheck()
+	b.mutex.Unlock()
+	if stopped != nil {
+		<-stopped
+	}
+
+	var err error
+	for _, backend := range backends {
+		if cerr := backend.Pool.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// CreateClient implements ClientFactory
+func (b *Balancer) CreateClient() (Client, error) {
+	return b.CreateClientContext(context.Background())
+}
+
+// CreateClientContext implements ContextClientFactory. It picks a
+// backend by the strategy and gets a client from its pool, through
+// its Limiter if the backend is limited.
+//
+// Backends that are unhealthy or ejected (see SetHealthCheck) are
+// not picked. Returns ErrNoBackend if there is no backend to pick.
+func (b *Balancer) CreateClientContext(ctx context.Context) (Client, error) {
+	b.mutex.Lock()
+	picked := b.pick(HashKey(ctx), time.Now())
+	if picked == nil {
+		b.mutex.Unlock()
+		return nil, ErrNoBackend
+	}
+	picked.outstanding++
+	b.mutex.Unlock()
+
+	factory := picked.Pool.CreateClientContext
+	if picked.limiter != nil {
+		factory = picked.limiter.CreateClientContext
+	}
+	c, err := factory(ctx)
+	if err != nil {
+		b.done(picked)
+		if ctx.Err() == nil && err != ErrPoolClosed && err != ErrQueueFull && err != ErrQueueTimeout {
+			b.report(picked, err)
+		}
+		return nil, err
+	}
+	return &balancedClient{Client: c, balancer: b, backend: picked}, nil
+}
+
+// done marks a client of the backend is no longer in use.
+func (b *Balancer) done(backend *backendState) {
+	b.mutex.Lock()
+	backend.outstanding--
+	b.mutex.Unlock()
+}
+
+// find returns the index of the backend of the given name, or -1
+// if not found. Must be called with b.mutex locked.
+func (b *Balancer) find(name string) int {
+	for i, backend := range b.backends {
+		if backend.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// pick picks a backend by the strategy, or nil if there is no
+// backend. Must be called with b.mutex locked.
+func (b *Balancer) pick(key string, now time.Time) *backendState {
+	backends := make([]*backendState, 0, len(b.backends))
+	for _, backend := range b.backends {
+		if backend.available(now) {
+			backends = append(backends, backend)
+		}
+	}
+	if len(backends) == 0 {
+		return nil
+	}
+	switch b.strategy {
+	case WeightedRoundRobin:
+		return b.pickWeighted(backends)
+	case LeastOutstanding:
+		return b.pickLeastOutstanding(backends)
+	case ConsistentHash:
+		if key != "" {
+			return b.pickHash(key, now)
+		}
+	}
+	return b.pickNext(backends)
+}
+
+// pickNext picks the backends in turn
+func (b *Balancer) pickNext(backends []*backendState) *backendState {
+	b.next = (b.next + 1) % len(backends)
+	return backends[b.next]
+}
+
+// pickWeighted implements the smooth weighted round-robin
+func (b *Balancer) pickWeighted(backends []*backendState) (picked *backendState) {
+	total := 0
+	for _, backend := range backends {
+		backend.current += backend.weight()
+		total += backend.weight()
+		if picked == nil || backend.current > picked.current {
+			picked = backend
+		}
+	}
+	picked.current -= total
+	return
+}
+
+// pickLeastOutstanding picks the backend with the least outstanding
+// clients per weight. Ties are broken in turn.
+func (b *Balancer) pickLeastOutstanding(backends []*backendState) (picked *backendState) {
+	b.next = (b.next + 1) % len(backends)
+	for i := range backends {
+		backend := backends[(b.next+i)%len(backends)]
+		if picked == nil ||
+			backend.outstanding*picked.weight() < picked.outstanding*backend.weight() {
+			picked = backend
+		}
+	}
+	return
+}
+
+// pickHash picks the backend of the key on the hash ring. If the
+// backend is not available, the next one on the ring is picked.
+func (b *Balancer) pickHash(key string, now time.Time) *backendState {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= hash
+	})
+	for i := 0; i < len(b.ring); i++ {
+		if backend := b.ring[(start+i)%len(b.ring)].backend; backend.available(now) {
+			return backend
+		}
+	}
+	return nil
+}
+
+// buildRing builds the hash ring of the backends, if needed.
+// Must be called with b.mutex locked.
+func (b *Balancer) buildRing() {
+	if b.strategy != ConsistentHash {
+		return
+	}
+	b.ring = b.ring[:0]
+	for _, backend := range b.backends {
+		for i := 0; i < ringReplicas*backend.weight(); i++ {
+			b.ring = append(b.ring, ringPoint{
+				hash:    crc32.ChecksumIEEE([]byte(backend.Name + "#" + strconv.Itoa(i))),
+				backend: backend,
+			})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+}
+
+// balancedClient is a client of a backend of a Balancer
+type balancedClient struct {
+	Client
+	balancer *Balancer
+	backend  *backendState
+	once     sync.Once
+}
+
+// Do implements Client.Do
+func (c *balancedClient) Do(req *Request) (resp *ResponsePipe, err error) {
+	return c.DoContext(req.Context(), req)
+}
+
+// DoContext implements Client.DoContext. The result of the
+// request is reported for the passive health check.
+func (c *balancedClient) DoContext(ctx context.Context, req *Request) (resp *ResponsePipe, err error) {
+	if resp, err = c.Client.DoContext(ctx, req); err != nil {
+		if isFailure(err) {
+			c.balancer.report(c.backend, err)
+		}
+		return
+	}
+	if c.balancer.passive() {
+		go func() {
+			if err := resp.Err(); err == nil || isFailure(err) {
+				c.balancer.report(c.backend, err)
+			}
+		}()
+	}
+	return
+}
+
+// getValues implements valuesGetter
+func (c *balancedClient) getValues(ctx context.Context) (Values, error) {
+	return clientValues(ctx, c.Client)
+}
+
+// Close implements Client.Close. It returns the client to
+// the pool of the backend.
+func (c *balancedClient) Close() error {
+	c.once.Do(func() {
+		c.balancer.done(c.backend)
+	})
+	return c.Client.Close()
+}
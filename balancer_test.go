@@ -0,0 +1,246 @@
+package gofast_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/yookoala/gofast"
+)
+
+// newTestBackend returns a backend of clients that
+// report the backend name on Do
+func newTestBackend(name string, weight int) gofast.Backend {
+	return gofast.Backend{
+		Name:   name,
+		Weight: weight,
+		Pool: gofast.NewPool(func(ctx context.Context) (gofast.Client, error) {
+			return gofast.ClientFunc(func(req *gofast.Request) (*gofast.ResponsePipe, error) {
+				return nil, fmt.Errorf("%s", name)
+			}), nil
+		}, gofast.PoolConfig{}),
+	}
+}
+
+// pickBackend returns the name of the backend picked by the
+// balancer for the context, and the client in use.
+func pickBackend(t *testing.T, b *gofast.Balancer, ctx context.Context) (string, gofast.Client) {
+	c, err := b.CreateClientContext(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, err = c.Do(gofast.NewRequest(nil))
+	return err.Error(), c
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	b, err := gofast.NewBalancer(gofast.RoundRobin,
+		newTestBackend("a", 1),
+		newTestBackend("b", 5),
+		newTestBackend("c", 1),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer b.Close()
+
+	count := map[string]int{}
+	for i := 0; i < 6; i++ {
+		name, c := pickBackend(t, b, context.Background())
+		c.Close()
+		count[name]++
+	}
+	if want, have := map[string]int{"a": 2, "b": 2, "c": 2}, count; !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestBalancer_WeightedRoundRobin(t *testing.T) {
+	b, err := gofast.NewBalancer(gofast.WeightedRoundRobin,
+		newTestBackend("a", 5),
+		newTestBackend("b", 1),
+		newTestBackend("c", 1),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer b.Close()
+
+	var picks []string
+	for i := 0; i < 7; i++ {
+		name, c := pickBackend(t, b, context.Background())
+		c.Close()
+		picks = append(picks, name)
+	}
+
+	// interleaved, as nginx does
+	if want, have := []string{"a", "a", "b", "a", "c", "a", "a"}, picks; !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestBalancer_LeastOutstanding(t *testing.T) {
+	b, err := gofast.NewBalancer(gofast.LeastOutstanding,
+		newTestBackend("a", 1),
+		newTestBackend("b", 2),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer b.Close()
+
+	// b takes twice the clients of a
+	count := map[string]int{}
+	clients := map[string][]gofast.Client{}
+	for i := 0; i < 6; i++ {
+		name, c := pickBackend(t, b, context.Background())
+		clients[name] = append(clients[name], c)
+		count[name]++
+	}
+	if want, have := map[string]int{"a": 2, "b": 4}, count; !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// returning clients of a makes it the least outstanding
+	for _, c := range clients["a"] {
+		c.Close()
+	}
+	for i := 0; i < 2; i++ {
+		name, _ := pickBackend(t, b, context.Background())
+		if want, have := "a", name; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	}
+}
+
+func TestBalancer_ConsistentHash(t *testing.T) {
+	b, err := gofast.NewBalancer(gofast.ConsistentHash,
+		newTestBackend("a", 1),
+		newTestBackend("b", 1),
+		newTestBackend("c", 1),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer b.Close()
+
+	pick := func(key string) string {
+		name, c := pickBackend(t, b, gofast.WithHashKey(context.Background(), key))
+		c.Close()
+		return name
+	}
+
+	keys := make([]string, 100)
+	picked := make(map[string]string)
+	count := map[string]int{}
+	for i := range keys {
+		keys[i] = fmt.Sprintf("session-%d", i)
+		picked[keys[i]] = pick(keys[i])
+		count[picked[keys[i]]]++
+	}
+	if len(count) != 3 {
+		t.Errorf("expected keys on all backends, got %#v", count)
+	}
+
+	// the same key goes to the same backend
+	for _, key := range keys {
+		if want, have := picked[key], pick(key); want != have {
+			t.Errorf("key %s: expected %#v, got %#v", key, want, have)
+		}
+	}
+
+	// removing a backend only moves its keys
+	if !b.Remove("c") {
+		t.Fatalf("expected backend c to be removed")
+	}
+	for _, key := range keys {
+		have := pick(key)
+		if picked[key] != "c" && picked[key] != have {
+			t.Errorf("key %s: expected %#v, got %#v", key, picked[key], have)
+		} else if have == "c" {
+			t.Errorf("key %s: picked removed backend", key)
+		}
+	}
+
+	// adding it back restores the keys
+	if err := b.Add(newTestBackend("c", 1)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, key := range keys {
+		if want, have := picked[key], pick(key); want != have {
+			t.Errorf("key %s: expected %#v, got %#v", key, want, have)
+		}
+	}
+}
+
+func TestBalancer_AddRemove(t *testing.T) {
+	b, err := gofast.NewBalancer(gofast.RoundRobin)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer b.Close()
+
+	if _, err := b.CreateClient(); err != gofast.ErrNoBackend {
+		t.Errorf("expected %#v, got %#v", gofast.ErrNoBackend, err)
+	}
+
+	b.Add(newTestBackend("a", 1))
+	if err := b.Add(newTestBackend("a", 1)); err == nil {
+		t.Errorf("expected error adding duplicated backend")
+	}
+	name, c := pickBackend(t, b, context.Background())
+	if want, have := "a", name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	c.Close()
+
+	if want, have := 1, len(b.Backends()); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if !b.Remove("a") {
+		t.Errorf("expected backend a to be removed")
+	}
+	if b.Remove("a") {
+		t.Errorf("expected no backend to be removed")
+	}
+	if _, err := b.CreateClient(); err != gofast.ErrNoBackend {
+		t.Errorf("expected %#v, got %#v", gofast.ErrNoBackend, err)
+	}
+}
+
+func TestBalancer_limit(t *testing.T) {
+	backend := newTestBackend("a", 1)
+	backend.Limit = &gofast.LimitConfig{MaxRequests: 1}
+	b, err := gofast.NewBalancer(gofast.RoundRobin, backend)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer b.Close()
+
+	_, c := pickBackend(t, b, context.Background())
+	if _, err := b.CreateClient(); err != gofast.ErrQueueFull {
+		t.Errorf("expected %#v, got %#v", gofast.ErrQueueFull, err)
+	}
+	stats, ok := b.LimitStats("a")
+	if !ok {
+		t.Fatalf("expected backend a to be limited")
+	}
+	if want, have := 1, stats.InFlight; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// the slot is freed with the request, while the
+	// client stays idle in the pool
+	c.Close()
+	_, c = pickBackend(t, b, context.Background())
+	c.Close()
+
+	// an overflow is not a failure of the backend
+	if want, have := 0, b.Health()[0].Fails; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if _, ok := b.LimitStats("b"); ok {
+		t.Errorf("expected no stats of unknown backend")
+	}
+}
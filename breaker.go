@@ -0,0 +1,353 @@
+package gofast
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+// States of CircuitBreaker
+const (
+	// CircuitClosed lets all requests through, and trips
+	// the breaker on too many failed or slow requests.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen fails all requests fast, until the
+	// open timeout has passed.
+	CircuitOpen
+
+	// CircuitHalfOpen lets a few trial requests through.
+	// The breaker is closed if they all succeed, or opened
+	// again if any of them fails.
+	CircuitHalfOpen
+)
+
+// String implements fmt.Stringer
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitOpenError is returned by CircuitBreaker when creating
+// a client while the breaker is open. A web server should respond
+// with 503 Service Unavailable, and Retry-After.
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+// Error implements error
+func (err *CircuitOpenError) Error() string {
+	return fmt.Sprintf("gofast: circuit breaker open, retry after %s", err.RetryAfter)
+}
+
+// Default values of BreakerConfig
+const (
+	DefaultBreakerWindow      = 10 * time.Second
+	DefaultBreakerMinRequests = 20
+	DefaultBreakerErrorRate   = 0.5
+	DefaultBreakerOpenTimeout = 30 * time.Second
+)
+
+// BreakerConfig configures a CircuitBreaker.
+type BreakerConfig struct {
+	// Window is the period the requests are counted over, while
+	// the breaker is closed. If zero, DefaultBreakerWindow is used.
+	Window time.Duration
+
+	// MinRequests is the number of requests in a window before the
+	// breaker can trip. If zero, DefaultBreakerMinRequests is used.
+	MinRequests int
+
+	// ErrorRate is the ratio of failed requests in a window to
+	// trip the breaker. Failures are dial errors, timeouts, broken
+	// connections, protocol errors and overloaded rejections.
+	//
+	// If both ErrorRate and SlowRate are zero,
+	// DefaultBreakerErrorRate is used.
+	ErrorRate float64
+
+	// SlowRate is the ratio of requests taking SlowDuration or
+	// longer (from the request being sent to its response being
+	// done) in a window to trip the breaker. Zero disables it.
+	SlowRate     float64
+	SlowDuration time.Duration
+
+	// OpenTimeout is the time the breaker stays open before it
+	// lets trial requests through. If zero,
+	// DefaultBreakerOpenTimeout is used.
+	OpenTimeout time.Duration
+
+	// HalfOpenRequests is the number of trial requests in the
+	// half-open state. Defaults to 1.
+	HalfOpenRequests int
+
+	// OnStateChange, if not nil, is called when the state of
+	// the breaker changes.
+	OnStateChange func(from, to CircuitState)
+}
+
+// CircuitBreaker stops creating clients from a factory while the
+// application keeps failing or is too slow, so requests fail fast
+// instead of piling up.
+type CircuitBreaker struct {
+	factory ContextClientFactory
+	config  BreakerConfig
+
+	// mutex guards all the fields below
+	mutex       sync.Mutex
+	state       CircuitState
+	generation  uint64
+	openUntil   time.Time
+	windowStart time.Time
+	total       int
+	failed      int
+	slow        int
+	trials      int
+	passed      int
+}
+
+// NewCircuitBreaker creates a CircuitBreaker of the factory.
+func NewCircuitBreaker(factory ContextClientFactory, config BreakerConfig) *CircuitBreaker {
+	if config.Window <= 0 {
+		config.Window = DefaultBreakerWindow
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = DefaultBreakerMinRequests
+	}
+	if config.ErrorRate <= 0 && config.SlowRate <= 0 {
+		config.ErrorRate = DefaultBreakerErrorRate
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultBreakerOpenTimeout
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = 1
+	}
+	return &CircuitBreaker{
+		factory:     factory,
+		config:      config,
+		windowStart: time.Now(),
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == CircuitOpen && !time.Now().Before(b.openUntil) {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// CreateClient implements ClientFactory
+func (b *CircuitBreaker) CreateClient() (Client, error) {
+	return b.CreateClientContext(context.Background())
+}
+
+// CreateClientContext implements ContextClientFactory. It returns
+// *CircuitOpenError while the breaker is open, or while the trial
+// requests of the half-open state are in progress.
+func (b *CircuitBreaker) CreateClientContext(ctx context.Context) (Client, error) {
+	generation, trial, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+	c, err := b.factory(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			b.release(generation, trial)
+		} else {
+			b.record(generation, false, 0)
+		}
+		return nil, err
+	}
+	return &breakerClient{
+		Client:     c,
+		breaker:    b,
+		generation: generation,
+		trial:      trial,
+	}, nil
+}
+
+// allow checks if a client can be created in the current state.
+// It returns the generation of the state, and if the client is
+// for a trial request.
+func (b *CircuitBreaker) allow() (generation uint64, trial bool, err error) {
+	var from, to CircuitState
+	defer func() { b.notify(from, to) }()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	for {
+		switch b.state {
+		case CircuitOpen:
+			if now.Before(b.openUntil) {
+				return 0, false, &CircuitOpenError{RetryAfter: b.openUntil.Sub(now)}
+			}
+			from, to = b.setState(CircuitHalfOpen, now)
+			continue
+		case CircuitHalfOpen:
+			if b.trials >= b.config.HalfOpenRequests {
+				// the trials may fail and open the breaker again
+				return 0, false, &CircuitOpenError{RetryAfter: b.config.OpenTimeout}
+			}
+			b.trials++
+			trial = true
+		}
+		return b.generation, trial, nil
+	}
+}
+
+// release gives back a trial that has not been used.
+func (b *CircuitBreaker) release(generation uint64, trial bool) {
+	if !trial {
+		return
+	}
+	b.mutex.Lock()
+	if b.generation == generation {
+		b.trials--
+	}
+	b.mutex.Unlock()
+}
+
+// record counts the result of a request made in the given
+// generation of the state, and trips or resets the breaker.
+func (b *CircuitBreaker) record(generation uint64, ok bool, latency time.Duration) {
+	var from, to CircuitState
+	defer func() { b.notify(from, to) }()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.generation != generation {
+		return
+	}
+	now := time.Now()
+	slow := b.config.SlowRate > 0 && latency >= b.config.SlowDuration
+
+	switch b.state {
+	case CircuitClosed:
+		if now.Sub(b.windowStart) >= b.config.Window {
+			b.windowStart, b.total, b.failed, b.slow = now, 0, 0, 0
+		}
+		b.total++
+		if !ok {
+			b.failed++
+		}
+		if slow {
+			b.slow++
+		}
+		if b.total >= b.config.MinRequests && b.tripped() {
+			from, to = b.setState(CircuitOpen, now)
+		}
+	case CircuitHalfOpen:
+		if !ok || slow {
+			from, to = b.setState(CircuitOpen, now)
+		} else if b.passed++; b.passed >= b.config.HalfOpenRequests {
+			from, to = b.setState(CircuitClosed, now)
+		}
+	}
+}
+
+// tripped reports if the counts of the window trip the breaker.
+// Must be called with b.mutex locked.
+func (b *CircuitBreaker) tripped() bool {
+	total := float64(b.total)
+	return (b.config.ErrorRate > 0 && float64(b.failed) >= b.config.ErrorRate*total) ||
+		(b.config.SlowRate > 0 && float64(b.slow) >= b.config.SlowRate*total)
+}
+
+// setState changes the state of the breaker, and returns the
+// transition for notify. Must be called with b.mutex locked.
+func (b *CircuitBreaker) setState(state CircuitState, now time.Time) (from, to CircuitState) {
+	from, to = b.state, state
+	b.state = state
+	b.generation++
+	b.windowStart, b.total, b.failed, b.slow = now, 0, 0, 0
+	b.trials, b.passed = 0, 0
+	if state == CircuitOpen {
+		b.openUntil = now.Add(b.config.OpenTimeout)
+	}
+	return
+}
+
+// notify calls OnStateChange, if the state is changed.
+// Must be called with b.mutex unlocked.
+func (b *CircuitBreaker) notify(from, to CircuitState) {
+	if b.config.OnStateChange != nil && from != to {
+		b.config.OnStateChange(from, to)
+	}
+}
+
+// breakerFailure reports if the error of a request counts as
+// a failure of the application.
+func breakerFailure(err error) bool {
+	switch err.(type) {
+	case *ConnError, *ProtocolError:
+		return true
+	}
+	return err == ErrTimeout || err == ErrOverloaded
+}
+
+// breakerClient is a client created by a CircuitBreaker
+type breakerClient struct {
+	Client
+	breaker    *CircuitBreaker
+	generation uint64
+	trial      bool
+	used       bool
+	once       sync.Once
+}
+
+// Do implements Client.Do
+func (c *breakerClient) Do(req *Request) (resp *ResponsePipe, err error) {
+	return c.DoContext(req.Context(), req)
+}
+
+// DoContext implements Client.DoContext. The result and the
+// latency of the request are counted by the breaker.
+func (c *breakerClient) DoContext(ctx context.Context, req *Request) (resp *ResponsePipe, err error) {
+	c.used = true
+	start := time.Now()
+	if resp, err = c.Client.DoContext(ctx, req); err != nil {
+		c.breaker.record(c.generation, !breakerFailure(err), time.Since(start))
+		return
+	}
+	go func() {
+		err := resp.Err()
+		if err == ErrCanceled {
+			c.breaker.release(c.generation, c.trial)
+			return
+		}
+		c.breaker.record(c.generation, !breakerFailure(err), time.Since(start))
+	}()
+	return
+}
+
+// getValues implements valuesGetter
+func (c *breakerClient) getValues(ctx context.Context) (Values, error) {
+	return clientValues(ctx, c.Client)
+}
+
+// Close implements Client.Close. A trial client closed without
+// a request gives back its trial.
+func (c *breakerClient) Close() error {
+	c.once.Do(func() {
+		if !c.used {
+			c.breaker.release(c.generation, c.trial)
+		}
+	})
+	return c.Client.Close()
+}
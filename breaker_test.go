@@ -0,0 +1,154 @@
+package gofast_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yookoala/gofast"
+)
+
+// completedClient returns a client of requests completed
+// after the delay
+func completedClient(delay time.Duration) gofast.Client {
+	return gofast.ClientFunc(func(req *gofast.Request) (*gofast.ResponsePipe, error) {
+		resp := gofast.NewResponsePipe()
+		go func() {
+			time.Sleep(delay)
+			resp.Close()
+		}()
+		return resp, nil
+	})
+}
+
+// expectState waits for the next state change
+func expectState(t *testing.T, changes <-chan gofast.CircuitState, want gofast.CircuitState) {
+	select {
+	case have := <-changes:
+		if want != have {
+			t.Errorf("expected %s, got %s", want, have)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected state change to %s", want)
+	}
+}
+
+func TestCircuitBreaker_errorRate(t *testing.T) {
+	var dials, failing int32 = 0, 1
+	factory := func(ctx context.Context) (gofast.Client, error) {
+		atomic.AddInt32(&dials, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return completedClient(0), nil
+	}
+	changes := make(chan gofast.CircuitState, 10)
+	b := gofast.NewCircuitBreaker(factory, gofast.BreakerConfig{
+		MinRequests: 4,
+		OpenTimeout: 50 * time.Millisecond,
+		OnStateChange: func(from, to gofast.CircuitState) {
+			changes <- to
+		},
+	})
+
+	for i := 0; i < 4; i++ {
+		if _, err := b.CreateClient(); err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+	expectState(t, changes, gofast.CircuitOpen)
+
+	// fails fast while open
+	_, err := b.CreateClient()
+	if oerr, ok := err.(*gofast.CircuitOpenError); !ok {
+		t.Errorf("expected *CircuitOpenError, got %#v", err)
+	} else if oerr.RetryAfter <= 0 {
+		t.Errorf("expected positive RetryAfter, got %s", oerr.RetryAfter)
+	}
+	if want, have := int32(4), atomic.LoadInt32(&dials); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// a trial request after the open timeout
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&failing, 0)
+	c, err := b.CreateClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectState(t, changes, gofast.CircuitHalfOpen)
+	if _, err := b.CreateClient(); err == nil {
+		t.Errorf("expected error while the trial is in progress")
+	} else if oerr, ok := err.(*gofast.CircuitOpenError); !ok {
+		t.Errorf("expected *CircuitOpenError, got %#v", err)
+	} else if want, have := 50*time.Millisecond, oerr.RetryAfter; want != have {
+		t.Errorf("expected %s, got %s", want, have)
+	}
+	resp, err := c.Do(gofast.NewRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.Err()
+	c.Close()
+	expectState(t, changes, gofast.CircuitClosed)
+	if want, have := gofast.CircuitClosed, b.State(); want != have {
+		t.Errorf("expected %s, got %s", want, have)
+	}
+}
+
+func TestCircuitBreaker_latency(t *testing.T) {
+	changes := make(chan gofast.CircuitState, 10)
+	b := gofast.NewCircuitBreaker(func(ctx context.Context) (gofast.Client, error) {
+		return completedClient(20 * time.Millisecond), nil
+	}, gofast.BreakerConfig{
+		MinRequests:  2,
+		SlowRate:     0.5,
+		SlowDuration: 10 * time.Millisecond,
+		OnStateChange: func(from, to gofast.CircuitState) {
+			changes <- to
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		c, err := b.CreateClient()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp, err := c.Do(gofast.NewRequest(nil))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Err()
+		c.Close()
+	}
+	expectState(t, changes, gofast.CircuitOpen)
+}
+
+func TestCircuitBreaker_handler(t *testing.T) {
+	b := gofast.NewCircuitBreaker(func(ctx context.Context) (gofast.Client, error) {
+		return nil, fmt.Errorf("connection refused")
+	}, gofast.BreakerConfig{
+		MinRequests: 1,
+		OpenTimeout: 1500 * time.Millisecond,
+	})
+	h := gofast.NewContextHandler(gofast.BasicSession, b.CreateClientContext)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if want, have := http.StatusBadGateway, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if want, have := http.StatusServiceUnavailable, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "2", w.Header().Get("Retry-After"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
@@ -14,24 +14,29 @@ package gofast
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/yookoala/gofast/protocol"
 )
 
 // Role for fastcgi application in spec
-type Role uint16
+type Role = protocol.Role
 
 // Roles specified in the fastcgi spec
 const (
-	RoleResponder Role = iota + 1
-	RoleAuthorizer
-	RoleFilter
+	RoleResponder  = protocol.RoleResponder
+	RoleAuthorizer = protocol.RoleAuthorizer
+	RoleFilter     = protocol.RoleFilter
 
 	MaxRequestID = ^uint16(0)
 )
@@ -40,9 +45,11 @@ const (
 // with a unique request ID allocted by the client
 func NewRequest(r *http.Request) (req *Request) {
 	req = &Request{
-		Raw:    r,
-		Role:   RoleResponder,
-		Params: make(map[string]string),
+		Raw:  r,
+		Role: RoleResponder,
+
+		// reuse the connection by default
+		KeepConn: true,
 	}
 
 	// if no http request, return here
@@ -58,12 +65,84 @@ func NewRequest(r *http.Request) (req *Request) {
 // Request hold information of a standard
 // FastCGI request
 type Request struct {
-	Raw      *http.Request
-	Role     Role
-	Params   map[string]string
-	Stdin    io.ReadCloser
-	Data     io.ReadCloser
+	Raw  *http.Request
+	Role Role
+
+	// Params are sent to the application in order
+	Params Params
+
+	Stdin io.ReadCloser
+	Data  io.ReadCloser
+
+	// KeepConn sets the FCGI_KEEP_CONN flag of the request. If false,
+	// the application closes the connection after the request, so
+	// the client cannot be reused. The request is then never sent
+	// along with other requests on the same connection.
 	KeepConn bool
+
+	// SendTimeout and ReadTimeout limit the inactivity of sending
+	// the request to, and of reading the response from, the
+	// application. If exceeded, the request fails with ErrTimeout
+	// and the connection is closed, which aborts the request on
+	// the application. Zero means no timeout.
+	//
+	// They are enforced with the deadlines of the connection, so
+	// only on connections that support deadlines (e.g. net.Conn).
+	// On a multiplexed connection, the longest timeouts of the
+	// requests in flight apply.
+	SendTimeout time.Duration
+	ReadTimeout time.Duration
+
+	// MaxResponseBuffer is the maximum number of bytes of each output
+	// stream (FCGI_STDOUT and FCGI_STDERR) buffered for the request
+	// but not yet read. The output is buffered so that a slow reader
+	// does not block the other requests multiplexed on the same
+	// connection. If exceeded, the request is aborted and fails with
+	// ErrResponseTooLarge. If zero, DefaultMaxResponseBuffer is used.
+	// If negative, there is no limit.
+	MaxResponseBuffer int
+
+	ctx context.Context
+}
+
+// DefaultMaxResponseBuffer is the default MaxResponseBuffer of Request.
+const DefaultMaxResponseBuffer = 32 << 20
+
+// maxResponseBuffer returns the limit of the buffered output
+// streams, or 0 if unlimited.
+func (req *Request) maxResponseBuffer() int {
+	switch {
+	case req.MaxResponseBuffer == 0:
+		return DefaultMaxResponseBuffer
+	case req.MaxResponseBuffer < 0:
+		return 0
+	}
+	return req.MaxResponseBuffer
+}
+
+// Context returns the context of the request. It is the context
+// set by WithContext, or the context of Raw if not set. Returns
+// context.Background() if neither exists.
+func (req *Request) Context() context.Context {
+	if req.ctx != nil {
+		return req.ctx
+	}
+	if req.Raw != nil {
+		return req.Raw.Context()
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of req with its context
+// changed to ctx. The provided ctx must be non-nil.
+func (req *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	req2 := new(Request)
+	*req2 = *req
+	req2.ctx = ctx
+	return req2
 }
 
 type idPool struct {
@@ -110,31 +189,224 @@ func newIDs() *idPool {
 	}
 }
 
+// pendingRequest keeps track of a request that is in flight
+// on a client connection.
+type pendingRequest struct {
+	resp *ResponsePipe
+
+	// timeouts of the request
+	sendTimeout time.Duration
+	readTimeout time.Duration
+
+	// canceled is set when the caller stops waiting for
+	// the request. Records of a canceled request are discarded.
+	canceled bool
+
+	// err is the connection error that ended the request,
+	// if any. Only read after done is closed.
+	err error
+
+	// end is the content of the FCGI_END_REQUEST record.
+	// Only read after done is closed.
+	end EndRequest
+
+	// done is closed when the FCGI_END_REQUEST record of
+	// the request is read, or when the connection failed.
+	done chan struct{}
+}
+
 // client is the default implementation of Client
 type client struct {
-	conn *conn
+	conn *conn // not changed after newClient
 	ids  *idPool
+
+	// mutex guards all the fields below
+	mutex sync.Mutex
+
+	// requests in flight, indexed by request ID
+	reqs map[uint16]*pendingRequest
+
+	// error that broke the connection read loop
+	err error
+
+	// discarded is set if the connection cannot be
+	// reused for new requests (e.g. an aborted request
+	// was not ended by the application in time)
+	discarded bool
+
+	// closing is set once a request without FCGI_KEEP_CONN
+	// has been taken. The application will close the connection
+	// after ending it, so no more request can be sent.
+	closing bool
+
+	// closed is set once the client is closed
+	closed bool
+
+	// time to wait for the application to end an aborted
+	// request before the connection is discarded
+	abortTimeout time.Duration
+
+	// the longest timeouts of the requests in flight, and
+	// the connection to apply them on (nil if unsupported)
+	sendTimeout time.Duration
+	readTimeout time.Duration
+	deadliner   deadliner
+
+	// starts the read loop on the first request
+	readOnce sync.Once
+
+	// number of requests in flight and the maximum
+	// allowed by the application
+	inflight int
+	maxReqs  int
+
+	// probed is set after a FCGI_GET_VALUES query
+	// has been sent for the connection capability
+	probed bool
+
+	// released is closed and renewed every time a
+	// request slot is freed or maxReqs is changed
+	released chan struct{}
+
+	// goroutines waiting for FCGI_GET_VALUES_RESULT
+	valuesWaiters []chan valuesResult
 }
 
-// writeRequest writes params and stdin to the FastCGI application
-func (c *client) writeRequest(reqID uint16, req *Request) (err error) {
+// valuesResult is the outcome of a FCGI_GET_VALUES query
+type valuesResult struct {
+	values Values
+	err    error
+}
+
+// newClient creates a client on the given connection.
+//
+// The client will only run one request at a time on the
+// connection until the application confirmed with
+// FCGI_MPXS_CONNS that it can multiplex.
+func newClient(rwc io.ReadWriteCloser) *client {
+	c := &client{
+		ids:      newIDs(),
+		reqs:     make(map[uint16]*pendingRequest),
+		maxReqs:  1,
+		released: make(chan struct{}),
+
+		abortTimeout: defaultAbortTimeout,
+	}
+	if d, ok := rwc.(deadliner); ok {
+		c.deadliner = d
+		rwc = &deadlineConn{rwc, c}
+	}
+	c.conn = newConn(rwc)
+	return c
+}
 
-	// end request whenever the function block ends
+// deadliner is implemented by connections with deadlines
+// (e.g. net.Conn).
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// deadlineConn applies the send timeout of the client before
+// every write, and extends the read deadline after it.
+type deadlineConn struct {
+	io.ReadWriteCloser
+	c *client
+}
+
+// Write implements io.Writer
+func (dc *deadlineConn) Write(p []byte) (n int, err error) {
+	c := dc.c
+	c.mutex.Lock()
+	if c.sendTimeout > 0 {
+		c.deadliner.SetWriteDeadline(time.Now().Add(c.sendTimeout))
+	} else {
+		c.deadliner.SetWriteDeadline(time.Time{})
+	}
+	c.mutex.Unlock()
+
+	if n, err = dc.ReadWriteCloser.Write(p); err == nil {
+		c.mutex.Lock()
+		c.touch()
+		c.mutex.Unlock()
+	}
+	return
+}
+
+// updateTimeouts applies the longest timeouts of the requests
+// in flight to the connection. Must be called with c.mutex locked.
+func (c *client) updateTimeouts() {
+	if c.deadliner == nil {
+		return
+	}
+	c.sendTimeout, c.readTimeout = 0, 0
+	for _, p := range c.reqs {
+		if p.sendTimeout > c.sendTimeout {
+			c.sendTimeout = p.sendTimeout
+		}
+		if p.readTimeout > c.readTimeout {
+			c.readTimeout = p.readTimeout
+		}
+	}
+	if c.readTimeout == 0 {
+		c.deadliner.SetReadDeadline(time.Time{})
+		return
+	}
+	c.touch()
+}
+
+// touch extends the read deadline of the connection on activity.
+// Must be called with c.mutex locked.
+func (c *client) touch() {
+	if c.deadliner != nil && c.readTimeout > 0 {
+		c.deadliner.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+}
+
+// defaultAbortTimeout is the default time to wait for the
+// application to end an aborted request.
+const defaultAbortTimeout = 1 * time.Second
+
+// writeRequest writes params and stdin to the FastCGI application.
+//
+// It reports to begun, exactly once, if FCGI_BEGIN_REQUEST has been
+// sent. It stops writing when the context is canceled.
+func (c *client) writeRequest(ctx context.Context, reqID uint16, req *Request, begun chan<- bool) (err error) {
+
+	// do not even begin the request if already canceled
+	if err = ctx.Err(); err != nil {
+		begun <- false
+		return
+	}
+
+	// errors other than reading the request streams
+	// or the context are from the connection
+	var readErr error
 	defer func() {
-		if err != nil {
-			// abort the request if there is any error
-			// in previous request writing process.
-			c.conn.writeAbortRequest(reqID)
-			return
+		if readErr != nil {
+			err = readErr
+		} else if isTimeout(err) {
+			// the record may be partially written, so the
+			// connection cannot be used anymore
+			c.discard()
+			c.conn.Close()
+			err = ErrTimeout
+		} else if err != nil && ctx.Err() == nil {
+			err = &ConnError{Op: "write", Err: err}
 		}
 	}()
 
 	// write request header with specified role
-	err = c.conn.writeBeginRequest(reqID, req.Role, 1)
+	var flags uint8
+	if req.KeepConn {
+		flags = flagKeepConn
+	}
+	err = c.conn.writeBeginRequest(reqID, req.Role, flags)
+	begun <- err == nil
 	if err != nil {
 		return
 	}
-	err = c.conn.writePairs(typeParams, reqID, req.Params)
+	err = c.conn.writePairs(typeParams, reqID, req.Params.pairs)
 	if err != nil {
 		return
 	}
@@ -146,10 +418,14 @@ func (c *client) writeRequest(reqID uint16, req *Request) (err error) {
 		p := make([]byte, 1024)
 		var count int
 		for {
+			if err = ctx.Err(); err != nil {
+				return
+			}
 			count, err = req.Stdin.Read(p)
 			if err == io.EOF {
 				err = nil
 			} else if err != nil {
+				readErr = fmt.Errorf("gofast: error reading request body: %s", err)
 				stdinWriter.Close()
 				return
 			}
@@ -176,10 +452,14 @@ func (c *client) writeRequest(reqID uint16, req *Request) (err error) {
 		p := make([]byte, 1024)
 		var count int
 		for {
+			if err = ctx.Err(); err != nil {
+				return
+			}
 			count, err = req.Data.Read(p)
 			if err == io.EOF {
 				err = nil
 			} else if err != nil {
+				readErr = fmt.Errorf("gofast: error reading request data: %s", err)
 				return
 			}
 			if count == 0 {
@@ -198,50 +478,381 @@ func (c *client) writeRequest(reqID uint16, req *Request) (err error) {
 	return
 }
 
-// readResponse read the FastCGI stdout and stderr, then write
-// to the response pipe. Protocol error will also be written
-// to the error writer in ResponsePipe.
-func (c *client) readResponse(ctx context.Context, resp *ResponsePipe, req *Request) (err error) {
+// broadcast wakes up every goroutine waiting for a request slot.
+// Must be called with c.mutex locked.
+func (c *client) broadcast() {
+	close(c.released)
+	c.released = make(chan struct{})
+}
 
-	var rec record
-	done := make(chan int)
+// acquire waits until the connection can take one more request.
+// A request without keepConn waits until it is the only request
+// on the connection, and no more request can be acquired after it.
+//
+// If the connection is busy and its multiplexing capability is
+// unknown, it also queries the application with FCGI_GET_VALUES.
+// If the query cannot be written, the connection is discarded.
+func (c *client) acquire(ctx context.Context, keepConn bool) (err error) {
+	c.mutex.Lock()
+	for {
+		if c.closed || c.conn == nil {
+			err = fmt.Errorf("client connection has been closed")
+			break
+		}
+		if c.err != nil {
+			err = c.err
+			break
+		}
+		if c.discarded {
+			err = fmt.Errorf("gofast: connection discarded")
+			break
+		}
+		if c.closing {
+			err = fmt.Errorf("gofast: connection is closing")
+			break
+		}
+		if !keepConn && c.inflight == 0 {
+			c.inflight++
+			c.closing = true
+			break
+		}
+		if keepConn && c.inflight < c.maxReqs {
+			c.inflight++
+			break
+		}
 
-	// readloop in goroutine
-	go func(rwc io.ReadWriteCloser) {
-	readLoop:
-		for {
-			if err := rec.read(rwc); err != nil {
-				break
-			}
+		probe := keepConn && !c.probed
+		c.probed = true
+		released := c.released
+		c.mutex.Unlock()
 
-			// different output type for different stream
-			switch rec.h.Type {
-			case typeStdout:
-				resp.stdOutWriter.Write(rec.content())
-			case typeStderr:
-				resp.stdErrWriter.Write(rec.content())
-			case typeEndRequest:
-				break readLoop
-			default:
-				err := fmt.Sprintf("unexpected type %#v in readLoop", rec.h.Type)
-				resp.stdErrWriter.Write([]byte(err))
+		if probe {
+			if err = c.conn.writeGetValues("FCGI_MPXS_CONNS", "FCGI_MAX_REQS"); err != nil {
+				// the connection cannot be trusted after a partial write
+				c.discard()
+				return &ConnError{Op: "write", Err: err}
 			}
 		}
-		close(done)
-	}(c.conn.rwc)
+
+		select {
+		case <-ctx.Done():
+			return ctxError(ctx)
+		case <-released:
+		}
+		c.mutex.Lock()
+	}
+	c.mutex.Unlock()
+	return
+}
+
+// register allocates a request ID and keeps track of the request
+// for the read loop. It also starts the read loop, if not yet started.
+func (c *client) register(resp *ResponsePipe, req *Request) (reqID uint16, p *pendingRequest, err error) {
+	reqID = c.ids.Alloc()
+	p = &pendingRequest{
+		resp:        resp,
+		sendTimeout: req.SendTimeout,
+		readTimeout: req.ReadTimeout,
+		done:        make(chan struct{}),
+	}
+
+	c.mutex.Lock()
+	if err = c.err; err != nil {
+		c.inflight--
+		c.broadcast()
+		c.mutex.Unlock()
+		c.ids.Release(reqID)
+		return
+	}
+	c.reqs[reqID] = p
+	c.updateTimeouts()
+	c.mutex.Unlock()
+
+	c.startReadLoop()
+	return
+}
+
+// startReadLoop starts the read loop, if not yet started.
+func (c *client) startReadLoop() {
+	if c.conn == nil {
+		return
+	}
+	rwc := c.conn.rwc
+	c.readOnce.Do(func() {
+		go c.readLoop(rwc)
+	})
+}
+
+// getValues queries the application with FCGI_GET_VALUES
+// and wait for the FCGI_GET_VALUES_RESULT.
+func (c *client) getValues(ctx context.Context) (v Values, err error) {
+	wait := make(chan valuesResult, 1)
+	c.mutex.Lock()
+	if c.closed || c.conn == nil {
+		c.mutex.Unlock()
+		err = fmt.Errorf("client connection has been closed")
+		return
+	}
+	if err = c.err; err != nil {
+		c.mutex.Unlock()
+		return
+	}
+	c.probed = true
+	c.valuesWaiters = append(c.valuesWaiters, wait)
+	c.mutex.Unlock()
+
+	c.startReadLoop()
+	if err = c.conn.writeGetValues(
+		"FCGI_MAX_CONNS",
+		"FCGI_MAX_REQS",
+		"FCGI_MPXS_CONNS",
+	); err != nil {
+		return
+	}
 
 	select {
 	case <-ctx.Done():
-		// do nothing, let client.Do handle
-		err = fmt.Errorf("gofast: timeout or canceled")
-	case <-done:
-		// do nothing and end the function
+		err = ctxError(ctx)
+	case result := <-wait:
+		v, err = result.values, result.err
 	}
 	return
 }
 
+// errValuesUnsupported is reported if the application replied
+// FCGI_GET_VALUES with FCGI_UNKNOWN_TYPE.
+var errValuesUnsupported = errors.New("gofast: application does not support FCGI_GET_VALUES")
+
+// ping checks if the application still answers on the
+// connection, with a FCGI_GET_VALUES query.
+func (c *client) ping(ctx context.Context) error {
+	if _, err := c.getValues(ctx); err != nil && err != errValuesUnsupported {
+		return err
+	}
+	return nil
+}
+
+// notifyValues passes the result of FCGI_GET_VALUES query to
+// all waiting goroutines. Must be called with c.mutex locked.
+func (c *client) notifyValues(v Values, err error) {
+	for _, wait := range c.valuesWaiters {
+		wait <- valuesResult{v, err}
+	}
+	c.valuesWaiters = nil
+}
+
+// finish ends the tracking of a request by the read loop.
+// Must be called with c.mutex locked.
+func (c *client) finish(reqID uint16, p *pendingRequest, err error) {
+	delete(c.reqs, reqID)
+	c.updateTimeouts()
+	p.err = err
+	close(p.done)
+}
+
+// release frees the request ID and the request slot. It should
+// only be called when the request is no longer read or written.
+func (c *client) release(reqID uint16) {
+	c.mutex.Lock()
+	c.ids.Release(reqID)
+	c.inflight--
+	c.broadcast()
+	c.mutex.Unlock()
+}
+
+// discard stops the connection from taking new requests.
+func (c *client) discard() {
+	c.mutex.Lock()
+	c.discarded = true
+	c.broadcast()
+	c.mutex.Unlock()
+}
+
+// usable reports if the connection can take new requests. It is
+// not if the connection is broken, discarded or closing.
+func (c *client) usable() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err == nil && !c.discarded && !c.closing && !c.closed
+}
+
+// abort stops a canceled request. It discards further records of
+// the request, sends FCGI_ABORT_REQUEST and waits briefly for the
+// application to end the request.
+//
+// If the application does not end the request in time, the connection
+// cannot be trusted to be in sync and will be discarded.
+func (c *client) abort(reqID uint16, p *pendingRequest, begun <-chan bool) {
+	c.mutex.Lock()
+	p.canceled = true
+	c.mutex.Unlock()
+
+	timeout := time.NewTimer(c.abortTimeout)
+	defer timeout.Stop()
+
+	select {
+	case sent := <-begun:
+		if !sent {
+			// the request never reached the application
+			c.mutex.Lock()
+			if c.reqs[reqID] == p {
+				c.finish(reqID, p, nil)
+			}
+			c.mutex.Unlock()
+			return
+		}
+	case <-timeout.C:
+		c.discard()
+		return
+	}
+
+	aborted := make(chan error, 1)
+	go func() {
+		aborted <- c.conn.writeAbortRequest(reqID)
+	}()
+	select {
+	case err := <-aborted:
+		if err != nil {
+			c.discard()
+			return
+		}
+	case <-timeout.C:
+		c.discard()
+		return
+	}
+
+	select {
+	case <-p.done:
+	case <-timeout.C:
+		c.discard()
+	}
+}
+
+// readLoop reads all records from the connection and demultiplexes
+// them to the pending requests by request ID, until the connection
+// fails or is closed.
+func (c *client) readLoop(r io.ReadCloser) {
+	pr := protocol.NewReader(r)
+	for {
+		rec, err := pr.ReadRecord()
+		if err != nil {
+			c.fail(err)
+			if isTimeout(err) {
+				// abort the requests on the application
+				r.Close()
+			}
+			return
+		}
+
+		// management records
+		if rec.Header.ID == protocol.NullRequestID {
+			c.handleManagement(rec)
+			continue
+		}
+
+		c.mutex.Lock()
+		c.touch()
+		p, ok := c.reqs[rec.Header.ID]
+		if !ok {
+			// record of an unknown request, discard
+			c.mutex.Unlock()
+			continue
+		}
+		if rec.Header.Type == typeEndRequest {
+			var err error
+			if rerr := p.end.read(rec.Content); rerr != nil {
+				err = &ProtocolError{Msg: "invalid FCGI_END_REQUEST", Err: rerr}
+			}
+			c.finish(rec.Header.ID, p, err)
+			c.mutex.Unlock()
+			continue
+		}
+		canceled := p.canceled
+		c.mutex.Unlock()
+		if canceled {
+			continue
+		}
+
+		// different output type for different stream
+		var werr error
+		switch rec.Header.Type {
+		case typeStdout:
+			_, werr = p.resp.stdOutWriter.Write(rec.Content)
+		case typeStderr:
+			_, werr = p.resp.stdErrWriter.Write(rec.Content)
+		default:
+			p.resp.setErr(&ProtocolError{
+				Msg: fmt.Sprintf("unexpected record type %s", rec.Header.Type),
+			})
+		}
+		if werr != nil {
+			// the output is not read. Abort the request,
+			// without blocking the other requests.
+			p.resp.fail(ErrResponseTooLarge)
+		}
+	}
+}
+
+// handleManagement handles management records (records with
+// request ID 0) from the application.
+func (c *client) handleManagement(rec protocol.Record) {
+	switch rec.Header.Type {
+	case typeGetValuesResult:
+		if len(rec.Content) == 0 {
+			// some applications terminate the result
+			// with an empty record, like a stream
+			return
+		}
+		values, err := parseValues(readPairs(rec.Content))
+		c.mutex.Lock()
+		if err == nil && values.MpxsConns {
+			c.maxReqs = int(MaxRequestID)
+			if values.MaxReqs > 0 {
+				c.maxReqs = values.MaxReqs
+			}
+		} else {
+			c.maxReqs = 1
+		}
+		c.broadcast()
+		c.notifyValues(values, err)
+		c.mutex.Unlock()
+	case typeUnknownType:
+		// the application does not understand FCGI_GET_VALUES.
+		// Keep running one request at a time.
+		c.mutex.Lock()
+		c.notifyValues(Values{}, errValuesUnsupported)
+		c.mutex.Unlock()
+	}
+}
+
+// fail ends all pending requests with the given error
+// and stops the client from taking new requests.
+func (c *client) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err == io.EOF && c.closing && len(c.reqs) == 0 {
+		// the application closed the connection after ending
+		// a request without FCGI_KEEP_CONN, as expected
+		c.err = fmt.Errorf("gofast: connection closed by application")
+		c.notifyValues(Values{}, c.err)
+		c.broadcast()
+		return
+	}
+	c.err = readError(err)
+	for reqID, p := range c.reqs {
+		c.finish(reqID, p, c.err)
+	}
+	c.notifyValues(Values{}, c.err)
+	c.broadcast()
+}
+
 // Do implements Client.Do
 func (c *client) Do(req *Request) (resp *ResponsePipe, err error) {
+	return c.DoContext(req.Context(), req)
+}
+
+// DoContext implements Client.DoContext
+func (c *client) DoContext(ctx context.Context, req *Request) (resp *ResponsePipe, err error) {
 
 	// validate the request
 	// if role is a filter, it has to have Data stream
@@ -249,13 +860,13 @@ func (c *client) Do(req *Request) (resp *ResponsePipe, err error) {
 		// validate the request
 		if req.Data == nil {
 			err = fmt.Errorf("filter request requires a data stream")
-		} else if _, ok := req.Params["FCGI_DATA_LAST_MOD"]; !ok {
+		} else if _, ok := req.Params.Lookup("FCGI_DATA_LAST_MOD"); !ok {
 			err = fmt.Errorf("filter request requires param FCGI_DATA_LAST_MOD")
-		} else if _, err = strconv.ParseUint(req.Params["FCGI_DATA_LAST_MOD"], 10, 32); err != nil {
+		} else if _, err = strconv.ParseUint(req.Params.Get("FCGI_DATA_LAST_MOD"), 10, 32); err != nil {
 			err = fmt.Errorf("invalid parsing FCGI_DATA_LAST_MOD (%s)", err)
-		} else if _, ok := req.Params["FCGI_DATA_LENGTH"]; !ok {
+		} else if _, ok := req.Params.Lookup("FCGI_DATA_LENGTH"); !ok {
 			err = fmt.Errorf("filter request requires param FCGI_DATA_LENGTH")
-		} else if _, err = strconv.ParseUint(req.Params["FCGI_DATA_LENGTH"], 10, 32); err != nil {
+		} else if _, err = strconv.ParseUint(req.Params.Get("FCGI_DATA_LENGTH"), 10, 32); err != nil {
 			err = fmt.Errorf("invalid parsing FCGI_DATA_LENGTH (%s)", err)
 		}
 
@@ -265,91 +876,155 @@ func (c *client) Do(req *Request) (resp *ResponsePipe, err error) {
 		}
 	}
 
-	// check if connection exists
-	if c.conn == nil {
-		err = fmt.Errorf("client connection has been closed")
+	// params must fit in the name-value pair encoding
+	if err = req.Params.check(); err != nil {
 		return
 	}
 
-	// allocate request ID
-	reqID := c.ids.Alloc()
-
-	// create response pipe
-	resp = NewResponsePipe()
-	rwError, allDone := make(chan error), make(chan int)
+	// keep the connection to unblock writing on cancel
+	cn := c.conn
 
-	// if there is a raw request, use the context deadline
-	var ctx context.Context
-	if req.Raw != nil {
-		ctx = req.Raw.Context()
-	} else {
-		ctx = context.TODO()
+	// wait for the connection to take the request,
+	// if it is not closed
+	if err = c.acquire(ctx, req.KeepConn); err != nil {
+		return
 	}
 
-	// wait group to wait for both read and write to end
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		wg.Wait()
-		close(allDone)
-	}()
+	// the request is also canceled if its output is not read
+	ctx, cancel := context.WithCancel(ctx)
+
+	// create response pipe and allocate request ID
+	resp = NewResponsePipe()
+	resp.cancel = cancel
+	resp.stdOutWriter.limit = req.maxResponseBuffer()
+	resp.stdErrWriter.limit = resp.stdOutWriter.limit
+	reqID, p, err := c.register(resp, req)
+	if err != nil {
+		cancel()
+		resp = nil
+		return
+	}
 
 	// Run read and write in parallel.
 	// Note: Specification never said "write before read".
 
 	// write the request through request pipe
+	writeErr, begun := make(chan error, 1), make(chan bool, 1)
 	go func() {
-		if err := c.writeRequest(reqID, req); err != nil {
-			rwError <- err
-		}
-		wg.Done()
+		writeErr <- c.writeRequest(ctx, reqID, req, begun)
 	}()
 
-	// get response from client and write through response pipe
-	go func() {
-		if err := c.readResponse(ctx, resp, req); err != nil {
-			rwError <- err
+	// wait for FCGI_BEGIN_REQUEST to be written, so that a broken
+	// connection is reported before the request reaches the
+	// application (e.g. for the caller to retry)
+	select {
+	case sent := <-begun:
+		begun <- sent
+		if !sent && ctx.Err() == nil {
+			err = <-writeErr
+			c.discard()
+			c.mutex.Lock()
+			if c.reqs[reqID] == p {
+				c.finish(reqID, p, nil)
+			}
+			c.mutex.Unlock()
+			c.release(reqID)
+			resp.Close()
+			cancel()
+			resp = nil
+			return
 		}
-		wg.Done()
-	}()
+	case <-ctx.Done():
+	}
 
 	// do not block the return of client.Do
 	// and return the response pipes
 	// (or else would be block by the response pipes not being used)
 	go func() {
-		// wait until context deadline
-		// or until writeError is not blocked.
-	loop:
-		for {
+		// wait until context deadline, until the response
+		// is fully read, or until the writing failed.
+		var werr error
+		written := false
+		select {
+		case <-p.done:
+		case werr = <-writeErr:
+			written = true
+			if werr == nil {
+				select {
+				case <-p.done:
+				case <-ctx.Done():
+				}
+			}
+		case <-ctx.Done():
+		}
+
+		// abort the request if it has not been ended
+		select {
+		case <-p.done:
+		default:
+			if ctx.Err() != nil {
+				resp.setErr(ctxError(ctx))
+			}
+			c.abort(reqID, p, begun)
+		}
+
+		// wait for the writing to end. If the request is
+		// canceled but the writing is stuck (e.g. the
+		// application stopped reading), close the connection
+		// to unblock it.
+		if !written && ctx.Err() != nil {
+			timeout := time.NewTimer(c.abortTimeout)
 			select {
-			case err := <-rwError:
-				// pass the read / write error to error stream
-				resp.stdErrWriter.Write([]byte(err.Error()))
-				continue
-			case <-allDone:
-				break loop
-				// do nothing
+			case werr = <-writeErr:
+				written = true
+			case <-timeout.C:
+				c.discard()
+				cn.Close()
+			}
+			timeout.Stop()
+		}
+		if !written {
+			werr = <-writeErr
+		}
+
+		// report the read / write error
+		if werr != nil && ctx.Err() == nil {
+			resp.setErr(werr)
+		}
+		select {
+		case <-p.done:
+			if p.canceled {
+				break
 			}
+			if p.err != nil {
+				resp.setErr(p.err)
+			} else {
+				resp.setEndRequest(p.end)
+			}
+		default:
 		}
 
 		// clean up
-		c.ids.Release(reqID)
 		resp.Close()
-		close(rwError)
+		cancel()
+		c.release(reqID)
 	}()
 	return
 }
 
 // Close implements Client.Close
 // If the inner connection has been closed before,
-// this method would do nothing and return nil
+// this method would do nothing and return nil.
+// It is safe for concurrent use with the requests.
 func (c *client) Close() (err error) {
-	if c.conn == nil {
+	c.mutex.Lock()
+	closed := c.closed
+	c.closed = true
+	c.mutex.Unlock()
+	if closed || c.conn == nil {
 		return
 	}
-	err = c.conn.Close()
-	c.conn = nil
-	return
+	return c.conn.Close()
 }
 
 // Client is a client interface of FastCGI
@@ -361,10 +1036,24 @@ type Client interface {
 	// Returns the response streams (stdout and stderr)
 	// and the request validation error.
 	//
-	// Note: protocol error will be written to the stderr
-	// stream in the ResponsePipe.
+	// Note: errors after the request is sent (e.g. protocol
+	// error) are reported by Err of the ResponsePipe.
+	//
+	// Do is safe for concurrent use. If the application
+	// reports FCGI_MPXS_CONNS=1, concurrent requests are
+	// multiplexed on the same connection. Otherwise they
+	// run one at a time.
+	//
+	// Do is a shortcut of DoContext with req.Context().
 	Do(req *Request) (resp *ResponsePipe, err error)
 
+	// DoContext does the FastCGI request like Do. The context
+	// applies to waiting for the connection, writing the
+	// request and reading the response. If the context is
+	// done before the request completes, the request is
+	// aborted.
+	DoContext(ctx context.Context, req *Request) (resp *ResponsePipe, err error)
+
 	// Close the underlying connection
 	Close() error
 }
@@ -380,10 +1069,78 @@ func SimpleConnFactory(network, address string) ConnFactory {
 	}
 }
 
+// ContextConnFactory creates new network connections
+// to the FPM application. The context applies to dialing.
+type ContextConnFactory func(ctx context.Context) (net.Conn, error)
+
+// SimpleContextConnFactory creates the simplest ContextConnFactory
+// implementation.
+func SimpleContextConnFactory(network, address string) ContextConnFactory {
+	var d net.Dialer
+	return func(ctx context.Context) (net.Conn, error) {
+		return d.DialContext(ctx, network, address)
+	}
+}
+
 // ClientFactory creates new FPM client with proper connection
 // to the FPM application.
 type ClientFactory func() (Client, error)
 
+// ContextClientFactory creates new FPM client with proper
+// connection to the FPM application. The context applies
+// to creating the client (e.g. dialing), not to the
+// requests made with the client.
+//
+// The CreateClient and CreateClientContext methods of ClientPool,
+// Balancer, CircuitBreaker and Limiter are factories themselves,
+// so they can be stacked on one another.
+type ContextClientFactory func(ctx context.Context) (Client, error)
+
+// ClientFactory returns a ClientFactory that calls the
+// ContextClientFactory with context.Background().
+func (f ContextClientFactory) ClientFactory() ClientFactory {
+	return func() (Client, error) {
+		return f(context.Background())
+	}
+}
+
+// ContextClientFactory returns a ContextClientFactory that
+// calls the ClientFactory. If the context is done before
+// the ClientFactory returns, the client is closed once
+// created.
+func (f ClientFactory) ContextClientFactory() ContextClientFactory {
+	return func(ctx context.Context) (Client, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, ctxError(ctx)
+		}
+		if ctx.Done() == nil {
+			// never canceled
+			return f()
+		}
+
+		type result struct {
+			c   Client
+			err error
+		}
+		created := make(chan result, 1)
+		go func() {
+			c, err := f()
+			created <- result{c, err}
+		}()
+		select {
+		case r := <-created:
+			return r.c, r.err
+		case <-ctx.Done():
+			go func() {
+				if r := <-created; r.err == nil {
+					r.c.Close()
+				}
+			}()
+			return nil, ctxError(ctx)
+		}
+	}
+}
+
 // SimpleClientFactory returns a ClientFactory implementation
 // with the given ConnFactory.
 func SimpleClientFactory(connFactory ConnFactory) ClientFactory {
@@ -395,19 +1152,54 @@ func SimpleClientFactory(connFactory ConnFactory) ClientFactory {
 		}
 
 		// create client
-		c = &client{
-			conn: newConn(conn),
-			ids:  newIDs(),
+		c = newClient(conn)
+		return
+	}
+}
+
+// SimpleContextClientFactory returns a ContextClientFactory
+// implementation with the given ContextConnFactory.
+func SimpleContextClientFactory(connFactory ContextConnFactory) ContextClientFactory {
+	return func(ctx context.Context) (c Client, err error) {
+		// connect to given network address
+		conn, err := connFactory(ctx)
+		if err != nil {
+			return
 		}
+
+		// create client
+		c = newClient(conn)
 		return
 	}
 }
 
+// EndRequest is the content of the FCGI_END_REQUEST record
+// that the application sends at the end of a request.
+type EndRequest struct {
+	// AppStatus is the application-level status code,
+	// i.e. the exit status of a CGI program.
+	AppStatus int
+
+	// ProtocolStatus is the protocol-level status code.
+	ProtocolStatus ProtocolStatus
+}
+
+func (er *EndRequest) read(content []byte) error {
+	var body protocol.EndRequest
+	if err := body.UnmarshalBinary(content); err != nil {
+		return err
+	}
+	er.AppStatus = int(body.AppStatus)
+	er.ProtocolStatus = body.ProtocolStatus
+	return nil
+}
+
 // NewResponsePipe returns an initialized new ResponsePipe struct
 func NewResponsePipe() (p *ResponsePipe) {
 	p = new(ResponsePipe)
-	p.stdOutReader, p.stdOutWriter = io.Pipe()
-	p.stdErrReader, p.stdErrWriter = io.Pipe()
+	p.stdOutWriter, p.stdErrWriter = newStreamBuffer(), newStreamBuffer()
+	p.stdOutReader, p.stdErrReader = p.stdOutWriter, p.stdErrWriter
+	p.done = make(chan struct{})
 	return
 }
 
@@ -415,15 +1207,117 @@ func NewResponsePipe() (p *ResponsePipe) {
 // all FastCGI output streams
 type ResponsePipe struct {
 	stdOutReader io.Reader
-	stdOutWriter io.WriteCloser
+	stdOutWriter *streamBuffer
 	stdErrReader io.Reader
-	stdErrWriter io.WriteCloser
+	stdErrWriter *streamBuffer
+
+	// cancel ends the request, if the pipes are of a client
+	cancel context.CancelFunc
+
+	// end request result and a flag if it is received.
+	// only read after done is closed
+	endRequest    EndRequest
+	hasEndRequest bool
+
+	// mutex guards err
+	mutex sync.Mutex
+	err   error
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// followLocal is set if a local redirect response should
+	// not be written, but kept in location to be followed
+	followLocal bool
+	location    string
+
+	// fileHeaders are the headers (e.g. X-Sendfile) of a file
+	// response to be served by the Handler, instead of the body.
+	// fileHeader and file are set if found in the response
+	fileHeaders []string
+	fileHeader  string
+	file        string
+
+	// headerLimits limits the response headers
+	headerLimits HeaderLimits
+}
+
+// setEndRequest stores the end request result of the
+// request. Should be called before Close.
+func (pipes *ResponsePipe) setEndRequest(er EndRequest) {
+	pipes.endRequest, pipes.hasEndRequest = er, true
+}
+
+// setErr stores the error of the request, if there is
+// none yet. Should be called before Close.
+func (pipes *ResponsePipe) setErr(err error) {
+	pipes.mutex.Lock()
+	defer pipes.mutex.Unlock()
+	if pipes.err == nil {
+		pipes.err = err
+	}
+}
+
+// Err returns the error that stopped the request from completing
+// normally, separated from the application error stream. It is one
+// of ErrCanceled, ErrTimeout, ErrOverloaded, ErrUnknownRole,
+// ErrResponseTooLarge, *ConnError or *ProtocolError. Returns nil if the request
+// is completed.
+//
+// Use ErrorStatus to find the HTTP status code for the error.
+//
+// It blocks until the pipes are closed. It should be called
+// after the output streams are drained (e.g. after WriteTo).
+func (pipes *ResponsePipe) Err() error {
+	<-pipes.done
+	pipes.mutex.Lock()
+	defer pipes.mutex.Unlock()
+	if pipes.err != nil {
+		return pipes.err
+	}
+	if pipes.hasEndRequest {
+		return rejectedError(pipes.endRequest.ProtocolStatus)
+	}
+	return nil
+}
+
+// EndRequest returns the FCGI_END_REQUEST content sent by the
+// application. If the request ended without FCGI_END_REQUEST
+// (e.g. canceled or connection broken), ok will be false.
+//
+// It blocks until the pipes are closed. It should be called
+// after the output streams are drained (e.g. after WriteTo).
+func (pipes *ResponsePipe) EndRequest() (er EndRequest, ok bool) {
+	<-pipes.done
+	return pipes.endRequest, pipes.hasEndRequest
+}
+
+// fail ends the output streams and the request with the error.
+func (pipes *ResponsePipe) fail(err error) {
+	pipes.setErr(err)
+	pipes.stdOutWriter.closeWrite(err)
+	pipes.stdErrWriter.closeWrite(err)
+	if pipes.cancel != nil {
+		pipes.cancel()
+	}
+}
+
+// discard discards the rest of the output, and ends the
+// request if the pipes are of a client.
+func (pipes *ResponsePipe) discard() {
+	pipes.stdOutWriter.Close()
+	if pipes.cancel != nil {
+		pipes.cancel()
+	}
 }
 
 // Close close all writers
 func (pipes *ResponsePipe) Close() {
-	pipes.stdOutWriter.Close()
-	pipes.stdErrWriter.Close()
+	pipes.stdOutWriter.closeWrite(io.EOF)
+	pipes.stdErrWriter.closeWrite(io.EOF)
+	pipes.closeOnce.Do(func() {
+		close(pipes.done)
+	})
 }
 
 // WriteTo writes the given output into http.ResponseWriter
@@ -462,81 +1356,64 @@ func (pipes *ResponsePipe) writeError(w io.Writer) (err error) {
 
 // writeTo writes the given output into http.ResponseWriter
 func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
-	linebody := bufio.NewReaderSize(pipes.stdOutReader, 1024)
-	headers := make(http.Header)
-	statusCode := 0
-	headerLines := 0
-	sawBlankLine := false
-
-	for {
-		var line []byte
-		var isPrefix bool
-		line, isPrefix, err = linebody.ReadLine()
-		if isPrefix {
-			w.WriteHeader(http.StatusInternalServerError)
-			err = fmt.Errorf("gofast: long header line from subprocess")
+	linebody := bufio.NewReader(pipes.stdOutReader)
+	h, err := readResponseHeader(linebody, pipes.headerLimits)
+	if err == io.ErrUnexpectedEOF {
+		// the request may have failed (e.g. rejected by the
+		// application, connection broken), without any output.
+		// (only check on EOF, which implies the pipes are closed)
+		if err = pipes.Err(); err != nil {
+			w.WriteHeader(ErrorStatus(err))
 			return
 		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		err = &HeaderError{Msg: "no end of headers"}
+	}
+	if err != nil {
+		if _, ok := err.(*HeaderError); !ok {
 			err = fmt.Errorf("gofast: error reading headers: %v", err)
-			return
 		}
-		if len(line) == 0 {
-			sawBlankLine = true
-			break
-		}
-		headerLines++
-		parts := strings.SplitN(string(line), ":", 2)
-		if len(parts) < 2 {
-			err = fmt.Errorf("gofast: bogus header line: %s", string(line))
-			return
-		}
-		header, val := parts[0], parts[1]
-		header = strings.TrimSpace(header)
-		val = strings.TrimSpace(val)
-		switch {
-		case header == "Status":
-			if len(val) < 3 {
-				err = fmt.Errorf("gofast: bogus status (short): %q", val)
-				return
+		w.WriteHeader(http.StatusBadGateway)
+		io.Copy(ioutil.Discard, linebody)
+		return
+	}
+	headers, statusCode := h.header, h.status
+
+	for _, name := range pipes.fileHeaders {
+		if file := headers.Get(name); file != "" {
+			// file response, to be served by the Handler
+			// with the other headers
+			pipes.fileHeader, pipes.file = name, file
+			for _, name := range pipes.fileHeaders {
+				headers.Del(name)
 			}
-			var code int
-			code, err = strconv.Atoi(val[0:3])
-			if err != nil {
-				err = fmt.Errorf("gofast: bogus status: %q\nline was %q",
-					val, line)
-				return
+			headers.Del("Content-Length")
+			for k, vv := range headers {
+				for _, v := range vv {
+					w.Header().Add(k, v)
+				}
 			}
-			statusCode = code
-		default:
-			headers.Add(header, val)
+			_, err = io.Copy(ioutil.Discard, linebody)
+			return
 		}
 	}
-	if headerLines == 0 || !sawBlankLine {
-		w.WriteHeader(http.StatusInternalServerError)
-		err = fmt.Errorf("gofast: no headers")
-		return
-	}
 
 	if loc := headers.Get("Location"); loc != "" {
-		/*
-			if strings.HasPrefix(loc, "/") && h.PathLocationHandler != nil {
-				h.handleInternalRedirect(rw, req, loc)
-				return
-			}
-		*/
+		if statusCode == 0 && pipes.followLocal && isLocalLocation(loc) {
+			// local redirect response (RFC 3875, 6.2.2),
+			// to be followed by the Handler
+			pipes.location = loc
+			_, err = io.Copy(ioutil.Discard, linebody)
+			return
+		}
 		if statusCode == 0 {
 			statusCode = http.StatusFound
 		}
 	}
 
 	if statusCode == 0 && headers.Get("Content-Type") == "" {
-		w.WriteHeader(http.StatusInternalServerError)
-		err = fmt.Errorf("gofast: missing required Content-Type in headers")
+		w.WriteHeader(http.StatusBadGateway)
+		err = &HeaderError{Msg: "missing required Content-Type"}
+		io.Copy(ioutil.Discard, linebody)
 		return
 	}
 
@@ -545,9 +1422,12 @@ func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
 	}
 
 	// Copy headers to rw's headers, after we've decided not to
-	// go into handleInternalRedirect, which won't want its rw
-	// headers to have been touched.
+	// follow a local redirect, which won't want its rw headers
+	// to have been touched.
 	for k, vv := range headers {
+		if k == "X-Accel-Buffering" {
+			continue
+		}
 		for _, v := range vv {
 			w.Header().Add(k, v)
 		}
@@ -555,13 +1435,50 @@ func (pipes *ResponsePipe) writeResponse(w http.ResponseWriter) (err error) {
 
 	w.WriteHeader(statusCode)
 
-	_, err = io.Copy(w, linebody)
+	// flush the output of each record to the client, if streamed
+	var body io.Writer = w
+	if f, ok := w.(http.Flusher); ok && flushOutput(headers) {
+		f.Flush()
+		body = flushWriter{w, f}
+	}
+
+	_, err = io.Copy(body, linebody)
 	if err != nil {
 		err = fmt.Errorf("gofast: copy error: %v", err)
 	}
 	return
 }
 
+// flushOutput reports if the output of the response should be
+// flushed on every record. It is on for text/event-stream, and
+// the application may switch it with the X-Accel-Buffering
+// header (as with nginx): "no" to flush, "yes" to buffer.
+func flushOutput(headers http.Header) bool {
+	switch strings.ToLower(headers.Get("X-Accel-Buffering")) {
+	case "no":
+		return true
+	case "yes":
+		return false
+	}
+	mediaType := strings.TrimSpace(strings.SplitN(headers.Get("Content-Type"), ";", 2)[0])
+	return strings.EqualFold(mediaType, "text/event-stream")
+}
+
+// flushWriter flushes after every write
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+// Write implements io.Writer
+func (fw flushWriter) Write(p []byte) (n int, err error) {
+	n, err = fw.w.Write(p)
+	if n > 0 {
+		fw.f.Flush()
+	}
+	return
+}
+
 // ClientFunc is a function wrapper of a Client interface
 // shortcut implementation. Mainly for testing and development
 // purpose.
@@ -572,6 +1489,12 @@ func (c ClientFunc) Do(req *Request) (resp *ResponsePipe, err error) {
 	return c(req)
 }
 
+// DoContext implements Client.DoContext. The function is
+// called with the request of the given context.
+func (c ClientFunc) DoContext(ctx context.Context, req *Request) (resp *ResponsePipe, err error) {
+	return c(req.WithContext(ctx))
+}
+
 // Close implements Client.Close
 func (c ClientFunc) Close() error {
 	return nil
@@ -1,9 +1,16 @@
 package gofast
 
 import (
+	"bytes"
+	"context"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/yookoala/gofast/protocol"
 )
 
 // requestId is supposed to be unique among all active requests in a connection. So a requestId
@@ -108,3 +115,123 @@ func TestIDPool_block(t *testing.T) {
 		t.Errorf("unexpected blocking")
 	}
 }
+
+// newAbortTestApp creates a dummy FastCGI application that never
+// ends the requests by itself. It reports all the record types
+// received. If ackAbort is true, it ends the request on
+// FCGI_ABORT_REQUEST.
+func newAbortTestApp(t *testing.T, ackAbort bool) (l net.Listener, received <-chan recType) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	types := make(chan recType, 100)
+	go func() {
+		rwc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c := newConn(rwc)
+		defer c.Close()
+		r := protocol.NewReader(rwc)
+		for {
+			rec, err := r.ReadRecord()
+			if err != nil {
+				return
+			}
+			types <- rec.Header.Type
+			if rec.Header.Type == typeAbortRequest && ackAbort {
+				c.writeEndRequest(rec.Header.ID, 0, StatusRequestComplete)
+			}
+		}
+	}()
+	return l, types
+}
+
+func TestClient_abort(t *testing.T) {
+	for _, ackAbort := range []bool{true, false} {
+		l, received := newAbortTestApp(t, ackAbort)
+		defer l.Close()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		c := newClient(conn)
+		c.abortTimeout = 50 * time.Millisecond
+		pool := NewPool(func(ctx context.Context) (Client, error) {
+			return c, nil
+		}, PoolConfig{})
+		pc, _ := pool.get(context.Background())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		resp, err := pc.Do(NewRequest(r))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		// cancel after the request reached the application
+		if want, have := typeBeginRequest, <-received; want != have {
+			t.Fatalf("expected %s, got %s", want, have)
+		}
+		cancel()
+
+		w, errBuffer := httptest.NewRecorder(), new(bytes.Buffer)
+		resp.WriteTo(w, errBuffer)
+		if want, have := ErrCanceled, resp.Err(); want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		if want, have := "", errBuffer.String(); want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		if want, have := http.StatusBadGateway, w.Code; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+
+		// application should receive the abort request
+		aborted := false
+		for !aborted {
+			select {
+			case recType := <-received:
+				aborted = recType == typeAbortRequest
+			case <-time.After(time.Second):
+				t.Fatalf("expected to receive %s, got nothing", typeAbortRequest)
+			}
+		}
+
+		// the connection is reusable only if the
+		// application ended the aborted request
+		if want, have := ackAbort, c.usable(); want != have {
+			t.Errorf("ackAbort=%t: expected usable %#v, got %#v", ackAbort, want, have)
+		}
+		pc.Close()
+		c.mutex.Lock()
+		closed := c.closed
+		c.mutex.Unlock()
+		if want, have := ackAbort, !closed; want != have {
+			t.Errorf("ackAbort=%t: expected connection kept %#v, got %#v", ackAbort, want, have)
+		}
+		c.Close()
+	}
+}
+
+func TestClient_acquireProbeError(t *testing.T) {
+	conn, app := net.Pipe()
+	app.Close()
+	c := newClient(conn)
+	defer c.Close()
+
+	// busy with a request, so the next one queries FCGI_GET_VALUES
+	c.inflight = 1
+	err := c.acquire(context.Background(), true)
+	if _, ok := err.(*ConnError); !ok {
+		t.Errorf("expected *ConnError, got %#v", err)
+	}
+	if want, have := false, c.usable(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := 1, c.inflight; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
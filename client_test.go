@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
@@ -71,7 +72,7 @@ func newAppServer(sockName string, fn http.HandlerFunc) (p *appServer, err error
 	return
 }
 
-func testHandlerForCancel(t *testing.T, p *appServer, w http.ResponseWriter, r *http.Request) (errStr string) {
+func testHandlerForCancel(t *testing.T, p *appServer, w http.ResponseWriter, r *http.Request) (errStr string, respErr error) {
 
 	NewRequest := func(r *http.Request) (req *gofast.Request) {
 		var isHTTPS string
@@ -90,20 +91,20 @@ func testHandlerForCancel(t *testing.T, p *appServer, w http.ResponseWriter, r *
 		}
 
 		req = gofast.NewRequest(r)
-		req.Params["CONTENT_TYPE"] = r.Header.Get("Content-Type")
-		req.Params["CONTENT_LENGTH"] = r.Header.Get("Content-Length")
-		req.Params["HTTPS"] = isHTTPS
-		req.Params["GATEWAY_INTERFACE"] = "CGI/1.1"
-		req.Params["REMOTE_ADDR"] = remoteAddr
-		req.Params["REMOTE_PORT"] = remotePort
-		req.Params["SERVER_PORT"] = serverPort
-		req.Params["SERVER_NAME"] = r.Host
-		req.Params["SERVER_PROTOCOL"] = r.Proto
-		req.Params["SERVER_SOFTWARE"] = "gofast"
-		req.Params["REDIRECT_STATUS"] = "200"
-		req.Params["REQUEST_METHOD"] = r.Method
-		req.Params["REQUEST_URI"] = r.RequestURI
-		req.Params["QUERY_STRING"] = r.URL.RawQuery
+		req.Params.Set("CONTENT_TYPE", r.Header.Get("Content-Type"))
+		req.Params.Set("CONTENT_LENGTH", r.Header.Get("Content-Length"))
+		req.Params.Set("HTTPS", isHTTPS)
+		req.Params.Set("GATEWAY_INTERFACE", "CGI/1.1")
+		req.Params.Set("REMOTE_ADDR", remoteAddr)
+		req.Params.Set("REMOTE_PORT", remotePort)
+		req.Params.Set("SERVER_PORT", serverPort)
+		req.Params.Set("SERVER_NAME", r.Host)
+		req.Params.Set("SERVER_PROTOCOL", r.Proto)
+		req.Params.Set("SERVER_SOFTWARE", "gofast")
+		req.Params.Set("REDIRECT_STATUS", "200")
+		req.Params.Set("REQUEST_METHOD", r.Method)
+		req.Params.Set("REQUEST_URI", r.RequestURI)
+		req.Params.Set("QUERY_STRING", r.URL.RawQuery)
 		return
 	}
 
@@ -143,6 +144,7 @@ func testHandlerForCancel(t *testing.T, p *appServer, w http.ResponseWriter, r *
 
 	errBuffer := new(bytes.Buffer)
 	resp.WriteTo(w, errBuffer)
+	respErr = resp.Err()
 
 	if errBuffer.Len() > 0 {
 		errStr = errBuffer.String()
@@ -183,8 +185,12 @@ func TestClient_canceled(t *testing.T) {
 		t.Errorf("expected %#v, got %#v", want, have)
 	}
 
-	// test error
-	if want, have := "gofast: timeout or canceled", testHandlerForCancel(t, p, w, r); want != have {
+	// test error, which is not in the error stream
+	errStr, respErr := testHandlerForCancel(t, p, w, r)
+	if want, have := "", errStr; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := gofast.ErrCanceled, respErr; want != have {
 		t.Errorf("expected %#v, got %#v", want, have)
 	}
 }
@@ -210,8 +216,8 @@ func TestClient_StdErr(t *testing.T) {
 		req := gofast.NewRequest(nil)
 
 		// Some required parameters with invalid values
-		req.Params["REQUEST_METHOD"] = ""
-		req.Params["SERVER_PROTOCOL"] = ""
+		req.Params.Set("REQUEST_METHOD", "")
+		req.Params.Set("SERVER_PROTOCOL", "")
 
 		// handle the result
 		resp, err := c.Do(req)
@@ -250,3 +256,356 @@ func TestClient_StdErr(t *testing.T) {
 		t.Errorf("expected %#v, got %#v", want, have)
 	}
 }
+
+func TestClient_multiplex(t *testing.T) {
+
+	// the handler of /first blocks until /second is served,
+	// so both requests must be in flight at the same time
+	secondServed := make(chan struct{})
+	p, err := newAppServer("client.test.sock", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/first":
+			select {
+			case <-secondServed:
+			case <-time.After(time.Second):
+				w.WriteHeader(http.StatusGatewayTimeout)
+			}
+		case "/second":
+			defer close(secondServed)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	defer p.Close()
+
+	c, err := gofast.SimpleClientFactory(
+		gofast.SimpleConnFactory(p.Network(), p.Address()),
+	)()
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	defer c.Close()
+
+	doRequest := func(path string) (result string) {
+		req := gofast.NewRequest(nil)
+		req.Params.Set("REQUEST_METHOD", "GET")
+		req.Params.Set("SERVER_PROTOCOL", "HTTP/1.1")
+		req.Params.Set("REQUEST_URI", path)
+		resp, err := c.Do(req)
+		if err != nil {
+			return err.Error()
+		}
+		w, errBuffer := httptest.NewRecorder(), new(bytes.Buffer)
+		if err = resp.WriteTo(w, errBuffer); err != nil {
+			return err.Error()
+		}
+		if errBuffer.Len() > 0 {
+			return errBuffer.String()
+		}
+		return fmt.Sprintf("%d %s", w.Code, w.Body.String())
+	}
+
+	results := make(chan string)
+	go func() {
+		results <- doRequest("/first")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if want, have := "200 hello /second", doRequest("/second"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "200 hello /first", <-results; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// concurrent requests on the same client
+	// should not mix up their responses
+	results = make(chan string)
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			path := fmt.Sprintf("/path/%d", i)
+			if have := doRequest(path); have != "200 hello "+path {
+				results <- fmt.Sprintf("expected %#v, got %#v", "200 hello "+path, have)
+				return
+			}
+			results <- ""
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		if msg := <-results; msg != "" {
+			t.Error(msg)
+		}
+	}
+}
+
+func TestClient_multiplexSlowReader(t *testing.T) {
+	srv := &gofast.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			if r.URL.Path == "/big" {
+				w.Write(bytes.Repeat([]byte("x"), 1<<20))
+				return
+			}
+			fmt.Fprintf(w, "hello %s", r.URL.Path)
+		}),
+	}
+	app, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	c, err := gofast.SimpleClientFactory(gofast.SimpleConnFactory("tcp", app.Addr().String()))()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	newRequest := func(path string) *gofast.Request {
+		req := gofast.NewRequest(nil)
+		req.KeepConn = true
+		req.MaxResponseBuffer = 64 << 10
+		req.Params.Set("REQUEST_METHOD", "GET")
+		req.Params.Set("SERVER_PROTOCOL", "HTTP/1.1")
+		req.Params.Set("REQUEST_URI", path)
+		return req
+	}
+
+	// the output of /big is not read
+	big, err := c.Do(newRequest("/big"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// the other request on the connection is not blocked
+	small := make(chan string, 1)
+	go func() {
+		resp, err := c.Do(newRequest("/small"))
+		if err != nil {
+			small <- err.Error()
+			return
+		}
+		w := httptest.NewRecorder()
+		if err := resp.WriteTo(w, ioutil.Discard); err != nil {
+			small <- err.Error()
+			return
+		}
+		small <- fmt.Sprintf("%d %s", w.Code, w.Body.String())
+	}()
+	select {
+	case have := <-small:
+		if want := "200 hello /small"; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("request blocked by the unread response")
+	}
+
+	// the unread request is aborted
+	resp, err := big.Response(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err != gofast.ErrResponseTooLarge {
+		t.Errorf("expected %#v, got %#v", gofast.ErrResponseTooLarge, err)
+	}
+	if want, have := gofast.ErrResponseTooLarge, big.Err(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestResponsePipe_EndRequest(t *testing.T) {
+	p, err := newAppServer("client.test.sock", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "hello world")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	defer p.Close()
+
+	c, err := gofast.SimpleClientFactory(
+		gofast.SimpleConnFactory(p.Network(), p.Address()),
+	)()
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	defer c.Close()
+
+	req := gofast.NewRequest(nil)
+	req.Params.Set("REQUEST_METHOD", "GET")
+	req.Params.Set("SERVER_PROTOCOL", "HTTP/1.1")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	w, errBuffer := httptest.NewRecorder(), new(bytes.Buffer)
+	if err = resp.WriteTo(w, errBuffer); err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+
+	er, ok := resp.EndRequest()
+	if !ok {
+		t.Fatalf("expected end request, got nothing")
+	}
+	if want, have := (gofast.EndRequest{AppStatus: 0, ProtocolStatus: gofast.StatusRequestComplete}), er; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// pipe without FCGI_END_REQUEST
+	resp = gofast.NewResponsePipe()
+	resp.Close()
+	if _, ok := resp.EndRequest(); ok {
+		t.Errorf("expected no end request")
+	}
+}
+
+func TestClient_keepConn(t *testing.T) {
+	p, err := newAppServer("client.test.sock", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "hello world")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	defer p.Close()
+
+	c, err := gofast.SimpleClientFactory(
+		gofast.SimpleConnFactory(p.Network(), p.Address()),
+	)()
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	defer c.Close()
+
+	doRequest := func(keepConn bool) (result string) {
+		req := gofast.NewRequest(nil)
+		req.KeepConn = keepConn
+		req.Params.Set("REQUEST_METHOD", "GET")
+		req.Params.Set("SERVER_PROTOCOL", "HTTP/1.1")
+		req.Params.Set("REQUEST_URI", "/")
+		resp, err := c.Do(req)
+		if err != nil {
+			return err.Error()
+		}
+		w, errBuffer := httptest.NewRecorder(), new(bytes.Buffer)
+		if err = resp.WriteTo(w, errBuffer); err != nil {
+			return err.Error()
+		}
+		if errBuffer.Len() > 0 {
+			return errBuffer.String()
+		}
+		return fmt.Sprintf("%d %s", w.Code, w.Body.String())
+	}
+
+	// connection is kept for more requests
+	for i := 0; i < 3; i++ {
+		if want, have := "200 hello world", doRequest(true); want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	}
+
+	// the application closes the connection after the request
+	// without FCGI_KEEP_CONN, which is not an error
+	if want, have := "200 hello world", doRequest(false); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// but the client cannot be used anymore
+	switch have := doRequest(true); have {
+	case "gofast: connection is closing":
+	case "gofast: connection closed by application":
+	default:
+		t.Errorf("expected the connection to be closed, got %#v", have)
+	}
+}
+
+func TestClient_DoContext(t *testing.T) {
+	p, err := newAppServer("client.test.sock", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "hello world")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	defer p.Close()
+
+	c, err := gofast.SimpleContextClientFactory(
+		gofast.SimpleContextConnFactory(p.Network(), p.Address()),
+	)(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	defer c.Close()
+
+	doRequest := func(uri string, timeout time.Duration) (code int, err error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		req := gofast.NewRequest(nil)
+		req.Params.Set("REQUEST_METHOD", "GET")
+		req.Params.Set("SERVER_PROTOCOL", "HTTP/1.1")
+		req.Params.Set("REQUEST_URI", uri)
+		resp, err := c.DoContext(ctx, req)
+		if err != nil {
+			return
+		}
+		w := httptest.NewRecorder()
+		resp.WriteTo(w, new(bytes.Buffer))
+		return w.Code, resp.Err()
+	}
+
+	// the deadline applies to reading the response
+	code, err := doRequest("/slow", 50*time.Millisecond)
+	if want, have := gofast.ErrTimeout, err; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := http.StatusGatewayTimeout, code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// the client is still usable after the abort
+	code, err = doRequest("/", time.Second)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if want, have := http.StatusOK, code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// dialing with a canceled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := gofast.SimpleContextClientFactory(
+		gofast.SimpleContextConnFactory(p.Network(), p.Address()),
+	)(ctx); err == nil {
+		t.Errorf("expected error dialing with canceled context")
+	}
+}
+
+func TestRequest_WithContext(t *testing.T) {
+	req := gofast.NewRequest(nil)
+	if want, have := context.Background(), req.Context(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req2 := req.WithContext(ctx)
+	if want, have := ctx, req2.Context(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := context.Background(), req.Context(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	r, _ := http.NewRequest("GET", "http://example.com/", nil)
+	r = r.WithContext(ctx)
+	if want, have := ctx, gofast.NewRequest(r).Context(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
@@ -0,0 +1,134 @@
+package gofast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/yookoala/gofast/protocol"
+)
+
+// Errors of a request reported by ResponsePipe.Err. They are about
+// the request handling, not from the application's error stream.
+var (
+	// ErrCanceled is reported if the request is canceled
+	// before it is completed.
+	ErrCanceled = errors.New("gofast: request canceled")
+
+	// ErrTimeout is reported if the request deadline is
+	// exceeded before it is completed, or if the send or
+	// read timeout of the request is exceeded.
+	ErrTimeout = errors.New("gofast: request timeout")
+
+	// ErrOverloaded is reported if the application rejected
+	// the request with FCGI_OVERLOADED or FCGI_CANT_MPX_CONN.
+	ErrOverloaded = errors.New("gofast: application overloaded")
+
+	// ErrUnknownRole is reported if the application rejected
+	// the request with FCGI_UNKNOWN_ROLE.
+	ErrUnknownRole = errors.New("gofast: application does not support the role")
+
+	// ErrResponseTooLarge is reported if the output of the
+	// request is not read while more than the MaxResponseBuffer
+	// of the request is buffered.
+	ErrResponseTooLarge = errors.New("gofast: response exceeds the buffer limit")
+)
+
+// ConnError is reported if the connection to the application
+// is broken (e.g. reset) in the middle of a request.
+type ConnError struct {
+	// Op is "read" or "write"
+	Op  string
+	Err error
+}
+
+// Error implements error
+func (err *ConnError) Error() string {
+	return fmt.Sprintf("gofast: connection broken on %s: %s", err.Op, err.Err)
+}
+
+// ProtocolError is reported if the application violates
+// the FastCGI protocol (e.g. sent a malformed record or
+// a record of unexpected type).
+type ProtocolError struct {
+	Msg string
+
+	// Err is the underlying error from package protocol,
+	// if any
+	Err error
+}
+
+// Error implements error
+func (err *ProtocolError) Error() string {
+	if err.Err != nil {
+		return fmt.Sprintf("gofast: protocol error: %s: %s", err.Msg, err.Err)
+	}
+	return fmt.Sprintf("gofast: protocol error: %s", err.Msg)
+}
+
+// readError classifies an error from reading records.
+func readError(err error) error {
+	if isTimeout(err) {
+		return ErrTimeout
+	}
+	switch err.(type) {
+	case *protocol.VersionError, *protocol.TruncatedError:
+		return &ProtocolError{Msg: "invalid record", Err: err}
+	}
+	return &ConnError{Op: "read", Err: err}
+}
+
+// isTimeout reports if err is a timeout of a connection deadline.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// ctxError returns the error reported for a done context.
+func ctxError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ErrCanceled
+}
+
+// rejectedError returns the error of an end request rejected
+// by the application. Returns nil if the request is completed.
+func rejectedError(status ProtocolStatus) error {
+	switch status {
+	case StatusRequestComplete:
+		return nil
+	case StatusUnknownRole:
+		return ErrUnknownRole
+	case StatusOverloaded, StatusCantMultiplex:
+		return ErrOverloaded
+	}
+	return &ProtocolError{Msg: fmt.Sprintf("unknown protocol status %s", status)}
+}
+
+// ErrorStatus returns the HTTP status code a web server should
+// respond for the error reported by ResponsePipe.Err:
+//
+//	ErrTimeout         504 Gateway Timeout
+//	ErrOverloaded      503 Service Unavailable
+//	*CircuitOpenError  503 Service Unavailable
+//	ErrQueueFull       503 Service Unavailable
+//	ErrQueueTimeout    503 Service Unavailable
+//	ErrUnknownRole     500 Internal Server Error
+//	others             502 Bad Gateway (e.g. *HeaderError)
+func ErrorStatus(err error) int {
+	if _, ok := err.(*CircuitOpenError); ok {
+		return http.StatusServiceUnavailable
+	}
+	switch err {
+	case ErrTimeout:
+		return http.StatusGatewayTimeout
+	case ErrOverloaded, ErrQueueFull, ErrQueueTimeout:
+		return http.StatusServiceUnavailable
+	case ErrUnknownRole:
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadGateway
+}
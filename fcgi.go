@@ -3,263 +3,143 @@
 // license that can be found in the LICENSE file.
 
 // Package gofast implements the FastCGI protocol.
-// Currently only the responder role is supported.
+// It implements both the web server side (Client, Handler) and
+// the application side (Server) of the responder, authorizer
+// and filter roles.
 // The protocol is defined at http://www.mit.edu/~yandros/doc/specs/fcgi-spec.html
+//
+// The record layer is implemented in the subpackage protocol.
 package gofast
 
-// This file defines the raw protocol and some utilities used by the child and
-// the host.
+// This file defines the connection utilities used by the
+// application side and the web server side.
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
-	"errors"
 	"io"
-	"sync"
+
+	"github.com/yookoala/gofast/protocol"
 )
 
 // recType is a record type, as defined by
 // http://www.fastcgi.com/devkit/doc/fcgi-spec.html#S8
-type recType uint8
+type recType = protocol.RecordType
 
 const (
-	typeBeginRequest    recType = 1
-	typeAbortRequest    recType = 2
-	typeEndRequest      recType = 3
-	typeParams          recType = 4
-	typeStdin           recType = 5
-	typeStdout          recType = 6
-	typeStderr          recType = 7
-	typeData            recType = 8
-	typeGetValues       recType = 9
-	typeGetValuesResult recType = 10
-	typeUnknownType     recType = 11
+	typeBeginRequest    = protocol.TypeBeginRequest
+	typeAbortRequest    = protocol.TypeAbortRequest
+	typeEndRequest      = protocol.TypeEndRequest
+	typeParams          = protocol.TypeParams
+	typeStdin           = protocol.TypeStdin
+	typeStdout          = protocol.TypeStdout
+	typeStderr          = protocol.TypeStderr
+	typeData            = protocol.TypeData
+	typeGetValues       = protocol.TypeGetValues
+	typeGetValuesResult = protocol.TypeGetValuesResult
+	typeUnknownType     = protocol.TypeUnknownType
 )
 
-// String implements fmt.Stringer
-func (t recType) String() string {
-	switch t {
-	case typeBeginRequest:
-		return "FCGI_BEGIN_REQUEST"
-	case typeAbortRequest:
-		return "FCGI_BEGIN_REQUEST"
-	case typeEndRequest:
-		return "FCGI_END_REQUEST"
-	case typeParams:
-		return "FCGI_PARAMS"
-	case typeStdin:
-		return "FCGI_STDIN"
-	case typeStdout:
-		return "FCGI_STDOUT"
-	case typeStderr:
-		return "FCGI_STDERR"
-	case typeData:
-		return "FCGI_DATA"
-	case typeGetValues:
-		return "FCGI_GET_VALUES"
-	case typeGetValuesResult:
-		return "FCGI_GET_VALUES_RESULT"
-	case typeUnknownType:
-		fallthrough
-	default:
-		return "FCGI_UNKNOWN_TYPE"
-	}
-}
-
-// GoString implements fmt.GoStringer
-func (t recType) GoString() string {
-	return t.String()
-}
-
 // keep the connection between web-server and responder open after request
-const flagKeepConn = 1
+const flagKeepConn = protocol.FlagKeepConn
 
-const (
-	maxWrite = 65535 // maximum record body
-	maxPad   = 255
-)
+const maxWrite = protocol.MaxContentLength // maximum record body
 
-const (
-	roleResponder = iota + 1 // only Responders are implemented.
-	roleAuthorizer
-	roleFilter
-)
+// ProtocolStatus is the protocolStatus component of
+// FCGI_END_REQUEST record, as defined by
+// http://www.mit.edu/~yandros/doc/specs/fcgi-spec.html#S5.5
+type ProtocolStatus = protocol.ProtocolStatus
 
+// Protocol status specified in the fastcgi spec
 const (
-	statusRequestComplete = iota
-	statusCantMultiplex
-	statusOverloaded
-	statusUnknownRole
+	StatusRequestComplete = protocol.StatusRequestComplete
+	StatusCantMultiplex   = protocol.StatusCantMultiplex
+	StatusOverloaded      = protocol.StatusOverloaded
+	StatusUnknownRole     = protocol.StatusUnknownRole
 )
 
-const headerLen = 8
-
-type header struct {
-	Version       uint8
-	Type          recType
-	ID            uint16
-	ContentLength uint16
-	PaddingLength uint8
-	Reserved      uint8
-}
-
-type beginRequest struct {
-	role     uint16
-	flags    uint8
-	reserved [5]uint8
-}
-
-func (br *beginRequest) read(content []byte) error {
-	if len(content) != 8 {
-		return errors.New("fcgi: invalid begin request record")
-	}
-	br.role = binary.BigEndian.Uint16(content)
-	br.flags = content[2]
-	return nil
-}
-
-// for padding so we don't have to allocate all the time
-// not synchronized because we don't care what the contents are
-var pad [maxPad]byte
-
-func (h *header) init(recType recType, reqID uint16, contentLength int) {
-	h.Version = 1
-	h.Type = recType
-	h.ID = reqID
-	h.ContentLength = uint16(contentLength)
-	h.PaddingLength = uint8(-contentLength & 7)
-}
-
 // conn sends records over rwc
 type conn struct {
-	mutex sync.Mutex
-	rwc   io.ReadWriteCloser
-
-	// to avoid allocations
-	buf bytes.Buffer
-	h   header
+	rwc io.ReadWriteCloser
+	w   *protocol.Writer
 }
 
 func newConn(rwc io.ReadWriteCloser) *conn {
-	return &conn{rwc: rwc}
+	return &conn{rwc: rwc, w: protocol.NewWriter(rwc)}
 }
 
 func (c *conn) Close() error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
 	return c.rwc.Close()
 }
 
-type record struct {
-	h   header
-	buf [maxWrite + maxPad]byte
-}
-
-func (rec *record) read(r io.Reader) (err error) {
-	if err = binary.Read(r, binary.BigEndian, &rec.h); err != nil {
-		return err
-	}
-	if rec.h.Version != 1 {
-		return errors.New("fcgi: invalid header version")
-	}
-	n := int(rec.h.ContentLength) + int(rec.h.PaddingLength)
-	if _, err = io.ReadFull(r, rec.buf[:n]); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (rec *record) content() []byte {
-	return rec.buf[:rec.h.ContentLength]
-}
-
 // writeRecord writes and sends a single record.
 func (c *conn) writeRecord(recType recType, reqID uint16, b []byte) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.buf.Reset()
-	c.h.init(recType, reqID, len(b))
-	if err := binary.Write(&c.buf, binary.BigEndian, c.h); err != nil {
-		return err
-	}
-	if _, err := c.buf.Write(b); err != nil {
-		return err
-	}
-	if _, err := c.buf.Write(pad[:c.h.PaddingLength]); err != nil {
-		return err
-	}
-	_, err := c.rwc.Write(c.buf.Bytes())
-	return err
+	return c.w.WriteRecord(recType, reqID, b)
 }
 
 func (c *conn) writeBeginRequest(reqID uint16, role Role, flags uint8) error {
-	b := [8]byte{byte(role >> 8), byte(role), flags}
-	return c.writeRecord(typeBeginRequest, reqID, b[:])
+	return c.w.WriteBody(typeBeginRequest, reqID, protocol.BeginRequest{Role: role, Flags: flags})
 }
 
-func (c *conn) writeEndRequest(reqID uint16, appStatus int, protocolStatus uint8) error {
-	b := make([]byte, 8)
-	binary.BigEndian.PutUint32(b, uint32(appStatus))
-	b[4] = protocolStatus
-	return c.writeRecord(typeEndRequest, reqID, b)
+func (c *conn) writeEndRequest(reqID uint16, appStatus int, protocolStatus ProtocolStatus) error {
+	return c.w.WriteBody(typeEndRequest, reqID, protocol.EndRequest{
+		AppStatus:      uint32(appStatus),
+		ProtocolStatus: protocolStatus,
+	})
 }
 
 func (c *conn) writeAbortRequest(reqID uint16) error {
 	return c.writeRecord(typeAbortRequest, reqID, nil)
 }
 
-func (c *conn) writePairs(recType recType, reqID uint16, pairs map[string]string) error {
+func (c *conn) writePairs(recType recType, reqID uint16, pairs []Param) error {
+	content, err := protocol.Pairs(pairs).MarshalBinary()
+	if err != nil {
+		return err
+	}
 	w := newWriter(c, recType, reqID)
-	b := make([]byte, 8)
-	for k, v := range pairs {
-		n := encodeSize(b, uint32(len(k)))
-		n += encodeSize(b[n:], uint32(len(v)))
-		if _, err := w.Write(b[:n]); err != nil {
-			return err
-		}
-		if _, err := w.WriteString(k); err != nil {
-			return err
-		}
-		if _, err := w.WriteString(v); err != nil {
-			return err
-		}
+	if _, err = w.Write(content); err != nil {
+		w.Close()
+		return err
 	}
-	w.Close()
-	return nil
+	return w.Close()
+}
+
+// writeGetValues sends a FCGI_GET_VALUES management record
+// that queries the given variables.
+//
+// Unlike the stream records, management record is not terminated
+// by an empty record.
+func (c *conn) writeGetValues(names ...string) error {
+	pairs := make(protocol.Pairs, len(names))
+	for i, name := range names {
+		pairs[i].Name = name
+	}
+	return c.w.WriteBody(typeGetValues, protocol.NullRequestID, pairs)
 }
 
-func readSize(s []byte) (uint32, int) {
-	if len(s) == 0 {
-		return 0, 0
-	}
-	size, n := uint32(s[0]), 1
-	if size&(1<<7) != 0 {
-		if len(s) < 4 {
-			return 0, 0
-		}
-		n = 4
-		size = binary.BigEndian.Uint32(s)
-		size &^= 1 << 31
+// writeGetValuesResult sends a FCGI_GET_VALUES_RESULT management
+// record with the given variables.
+func (c *conn) writeGetValuesResult(values map[string]string) error {
+	pairs := make(protocol.Pairs, 0, len(values))
+	for name, value := range values {
+		pairs = append(pairs, protocol.Pair{Name: name, Value: value})
 	}
-	return size, n
+	return c.w.WriteBody(typeGetValuesResult, protocol.NullRequestID, pairs)
 }
 
-func readString(s []byte, size uint32) string {
-	if size > uint32(len(s)) {
-		return ""
-	}
-	return string(s[:size])
+// writeUnknownType sends a FCGI_UNKNOWN_TYPE management record
+// in reply to a management record of unknown type.
+func (c *conn) writeUnknownType(unknown recType) error {
+	return c.w.WriteBody(typeUnknownType, protocol.NullRequestID, protocol.UnknownType{Type: unknown})
 }
 
-func encodeSize(b []byte, size uint32) int {
-	if size > 127 {
-		size |= 1 << 31
-		binary.BigEndian.PutUint32(b, size)
-		return 4
-	}
-	b[0] = byte(size)
-	return 1
+// readPairs parses name-value pairs from the content of
+// a FCGI_PARAMS or FCGI_GET_VALUES(_RESULT) stream. Pairs
+// after a truncation are ignored.
+func readPairs(content []byte) map[string]string {
+	var pairs protocol.Pairs
+	pairs.UnmarshalBinary(content)
+	return pairs.Map()
 }
 
 // bufWriter encapsulates bufio.Writer but also closes the underlying stream when
@@ -278,36 +158,7 @@ func (w *bufWriter) Close() error {
 }
 
 func newWriter(c *conn, recType recType, reqID uint16) *bufWriter {
-	s := &streamWriter{c: c, recType: recType, reqID: reqID}
+	s := protocol.NewStreamWriter(c.w, recType, reqID)
 	w := bufio.NewWriterSize(s, maxWrite)
 	return &bufWriter{s, w}
 }
-
-// streamWriter abstracts out the separation of a stream into discrete records.
-// It only writes maxWrite bytes at a time.
-type streamWriter struct {
-	c       *conn
-	recType recType
-	reqID   uint16
-}
-
-func (w *streamWriter) Write(p []byte) (int, error) {
-	nn := 0
-	for len(p) > 0 {
-		n := len(p)
-		if n > maxWrite {
-			n = maxWrite
-		}
-		if err := w.c.writeRecord(w.recType, w.reqID, p[:n]); err != nil {
-			return nn, err
-		}
-		nn += n
-		p = p[n:]
-	}
-	return nn, nil
-}
-
-func (w *streamWriter) Close() error {
-	// send empty record to close the stream
-	return w.c.writeRecord(w.recType, w.reqID, nil)
-}
@@ -0,0 +1,246 @@
+package gofast
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Default values of HeaderLimits
+const (
+	DefaultMaxHeaderBytes = 1 << 20
+	DefaultMaxHeaderLine  = 64 << 10
+	DefaultMaxHeaders     = 500
+)
+
+// HeaderLimits limits the CGI response headers of the application.
+// Responses exceeding the limits fail with *HeaderError.
+type HeaderLimits struct {
+	// MaxBytes is the maximum size of all the header lines. If
+	// zero, DefaultMaxHeaderBytes is used.
+	MaxBytes int
+
+	// MaxLine is the maximum length of a header field, including
+	// its continuation lines. If zero, DefaultMaxHeaderLine is used.
+	MaxLine int
+
+	// MaxCount is the maximum number of header fields. If zero,
+	// DefaultMaxHeaders is used.
+	MaxCount int
+}
+
+// WithHeaderLimits sets the limits of the response headers
+// of the application.
+func WithHeaderLimits(limits HeaderLimits) HandlerOption {
+	return func(h *defaultHandler) {
+		h.headerLimits = limits
+	}
+}
+
+// withDefaults returns the limits with default values filled in.
+func (limits HeaderLimits) withDefaults() HeaderLimits {
+	if limits.MaxBytes <= 0 {
+		limits.MaxBytes = DefaultMaxHeaderBytes
+	}
+	if limits.MaxLine <= 0 {
+		limits.MaxLine = DefaultMaxHeaderLine
+	}
+	if limits.MaxCount <= 0 {
+		limits.MaxCount = DefaultMaxHeaders
+	}
+	return limits
+}
+
+// HeaderError is reported if the CGI response headers of the
+// application are malformed, not allowed, or exceed the limits.
+// A web server should respond with 502 Bad Gateway.
+type HeaderError struct {
+	Msg string
+
+	// Line is the offending header line, if any
+	Line string
+}
+
+// Error implements error
+func (err *HeaderError) Error() string {
+	if err.Line != "" {
+		return fmt.Sprintf("gofast: invalid response header: %s: %q", err.Msg, err.Line)
+	}
+	return fmt.Sprintf("gofast: invalid response header: %s", err.Msg)
+}
+
+// headerError returns a *HeaderError of the line,
+// truncated if too long to report.
+func headerError(msg string, line []byte) *HeaderError {
+	const maxReported = 128
+	if len(line) > maxReported {
+		line = append(line[:maxReported:maxReported], "..."...)
+	}
+	return &HeaderError{Msg: msg, Line: string(line)}
+}
+
+// hopByHopHeaders are the headers of the connection to the
+// application, which must not be passed to the client.
+var hopByHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+}
+
+// responseHeader is the CGI response header of the application
+type responseHeader struct {
+	// status code and reason phrase of the Status header,
+	// or 0 and "" if there is none
+	status     int
+	statusText string
+
+	header http.Header
+}
+
+// readResponseHeader reads the CGI response header from r, up to
+// the blank line. Returns io.ErrUnexpectedEOF if the stream ended
+// before the blank line.
+func readResponseHeader(r *bufio.Reader, limits HeaderLimits) (h responseHeader, err error) {
+	limits = limits.withDefaults()
+	h.header = make(http.Header)
+
+	// the current header field, with its continuation lines
+	var field []byte
+	count, size := 0, 0
+
+	for {
+		var line []byte
+		if line, err = readHeaderLine(r, limits.MaxLine); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if size += len(line) + 2; size > limits.MaxBytes {
+			err = &HeaderError{Msg: fmt.Sprintf("headers larger than %d bytes", limits.MaxBytes)}
+			return
+		}
+		if bytes.IndexByte(line, '\r') >= 0 {
+			err = headerError("CR in header line", line)
+			return
+		}
+
+		// obs-fold: continuation of the previous field
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if field == nil {
+				err = headerError("continuation without header field", line)
+				return
+			}
+			field = append(append(field, ' '), bytes.TrimLeft(line, " \t")...)
+			if len(field) > limits.MaxLine {
+				err = headerError(fmt.Sprintf("header field longer than %d bytes", limits.MaxLine), field)
+				return
+			}
+			continue
+		}
+
+		if field != nil {
+			if err = h.add(field); err != nil {
+				return
+			}
+		}
+		if len(line) == 0 {
+			if count == 0 {
+				err = &HeaderError{Msg: "no headers"}
+			}
+			return
+		}
+		if count++; count > limits.MaxCount {
+			err = &HeaderError{Msg: fmt.Sprintf("more than %d header fields", limits.MaxCount)}
+			return
+		}
+		field = append([]byte(nil), line...)
+	}
+}
+
+// readHeaderLine reads a line of at most max bytes, without
+// the line ending.
+func readHeaderLine(r *bufio.Reader, max int) (line []byte, err error) {
+	for {
+		var part []byte
+		var isPrefix bool
+		if part, isPrefix, err = r.ReadLine(); err != nil {
+			return
+		}
+		line = append(line, part...)
+		if len(line) > max {
+			err = headerError(fmt.Sprintf("header line longer than %d bytes", max), line)
+			return
+		}
+		if !isPrefix {
+			return
+		}
+	}
+}
+
+// add parses and adds a header field.
+func (h *responseHeader) add(field []byte) error {
+	i := bytes.IndexByte(field, ':')
+	if i < 0 {
+		return headerError("missing colon", field)
+	}
+	name := string(field[:i])
+	value := strings.Trim(string(field[i+1:]), " \t")
+	if !validHeaderName(name) {
+		return headerError("invalid header name", field)
+	}
+	if !validHeaderValue(value) {
+		return headerError("invalid header value", field)
+	}
+	name = http.CanonicalHeaderKey(name)
+	if hopByHopHeaders[name] {
+		return headerError("hop-by-hop header not allowed", field)
+	}
+
+	if name != "Status" {
+		h.header.Add(name, value)
+		return nil
+	}
+	if len(value) < 3 {
+		return headerError("bogus status (short)", field)
+	}
+	code, err := strconv.Atoi(value[:3])
+	if err != nil || code < 100 || (len(value) > 3 && value[3] != ' ') {
+		return headerError("bogus status", field)
+	}
+	h.status = code
+	h.statusText = strings.TrimLeft(value[3:], " ")
+	return nil
+}
+
+// validHeaderName reports if the name is a token (RFC 7230, 3.2.6).
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue reports if the value has no control
+// characters other than horizontal tab (RFC 7230, 3.2).
+func validHeaderValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package gofast_test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yookoala/gofast"
+)
+
+func TestHandler_responseHeader(t *testing.T) {
+	longCookie := "id=" + strings.Repeat("x", 5000)
+	tests := []struct {
+		desc   string
+		limits gofast.HeaderLimits
+		header string
+		status int
+		name   string
+		value  string
+	}{
+		{
+			desc:   "long header line",
+			header: "Content-Type: text/plain\r\nSet-Cookie: " + longCookie + "\r\n",
+			status: http.StatusOK,
+			name:   "Set-Cookie",
+			value:  longCookie,
+		},
+		{
+			desc:   "obs-fold",
+			header: "Content-Type: text/plain\r\nX-Folded: a\r\n  b\r\n\tc\r\n",
+			status: http.StatusOK,
+			name:   "X-Folded",
+			value:  "a b c",
+		},
+		{
+			desc:   "status with reason phrase",
+			header: "Content-Type: text/plain\r\nStatus: 404 Not Found\r\n",
+			status: http.StatusNotFound,
+		},
+		{
+			desc:   "bogus status",
+			header: "Content-Type: text/plain\r\nStatus: 20x\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "CR injection",
+			header: "Content-Type: text/plain\r\nX-Foo: a\rX-Bar: b\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "control character in value",
+			header: "Content-Type: text/plain\r\nX-Foo: a\x00b\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "invalid header name",
+			header: "Content-Type: text/plain\r\nX Foo: a\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "space before colon",
+			header: "Content-Type : text/plain\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "hop-by-hop header",
+			header: "Content-Type: text/plain\r\nTransfer-Encoding: chunked\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "continuation without field",
+			header: " Content-Type: text/plain\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "no headers",
+			header: "",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "missing Content-Type",
+			header: "X-Foo: a\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "line too long",
+			limits: gofast.HeaderLimits{MaxLine: 100},
+			header: "Content-Type: text/plain\r\nX-Foo: " + strings.Repeat("a", 100) + "\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "folded line too long",
+			limits: gofast.HeaderLimits{MaxLine: 100},
+			header: "Content-Type: text/plain\r\nX-Foo: " + strings.Repeat("a", 60) + "\r\n " + strings.Repeat("a", 60) + "\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "too many headers",
+			limits: gofast.HeaderLimits{MaxCount: 2},
+			header: "Content-Type: text/plain\r\nX-Foo: a\r\nX-Bar: b\r\n",
+			status: http.StatusBadGateway,
+		},
+		{
+			desc:   "headers too large",
+			limits: gofast.HeaderLimits{MaxBytes: 100},
+			header: "Content-Type: text/plain\r\nX-Foo: " + strings.Repeat("a", 50) + "\r\nX-Bar: " + strings.Repeat("a", 50) + "\r\n",
+			status: http.StatusBadGateway,
+		},
+	}
+
+	for _, test := range tests {
+		l := newCGIApp(t, func(params map[string]string) string {
+			return test.header + "\r\nbody"
+		})
+		logs := new(bytes.Buffer)
+		h := newServerHandler(l, gofast.WithHeaderLimits(test.limits))
+		h.SetLogger(log.New(logs, "", 0))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		l.Close()
+
+		if want, have := test.status, w.Code; want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.desc, want, have)
+		}
+		if test.status == http.StatusBadGateway {
+			if want, have := "gofast: invalid response header", logs.String(); !strings.Contains(have, want) {
+				t.Errorf("%s: expected log to contain %#v, got %#v", test.desc, want, have)
+			}
+			continue
+		}
+		if want, have := "body", w.Body.String(); want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.desc, want, have)
+		}
+		if test.name != "" {
+			if want, have := test.value, w.Header().Get(test.name); want != have {
+				t.Errorf("%s: expected %#v, got %#v", test.desc, want, have)
+			}
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package gofast
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheckFunc checks if a backend is healthy. It returns
+// nil if healthy.
+type HealthCheckFunc func(ctx context.Context, backend Backend) error
+
+// CheckDial is a HealthCheckFunc that gets a client from the
+// pool of the backend. As broken connections are not reused,
+// a new connection is dialed if the backend closed them.
+func CheckDial(ctx context.Context, backend Backend) error {
+	c, err := backend.Pool.CreateClientContext(ctx)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// CheckGetValues is a HealthCheckFunc that queries the backend
+// with FCGI_GET_VALUES on a client from its pool.
+func CheckGetValues(ctx context.Context, backend Backend) error {
+	c, err := backend.Pool.CreateClientContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if pc, ok := c.(*PoolClient); ok {
+		return pc.ping(ctx)
+	}
+	return nil
+}
+
+// CheckScript returns a HealthCheckFunc that sends the request
+// built by newRequest (e.g. of a status script) to the backend,
+// and expects the response of the given status code.
+func CheckScript(newRequest func() *Request, status int) HealthCheckFunc {
+	return func(ctx context.Context, backend Backend) error {
+		c, err := backend.Pool.CreateClientContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		resp, err := c.DoContext(ctx, newRequest())
+		if err != nil {
+			return err
+		}
+		w := &statusRecorder{header: make(http.Header)}
+		if err = resp.WriteTo(w, new(bytes.Buffer)); err != nil {
+			return err
+		}
+		if err = resp.Err(); err != nil {
+			return err
+		}
+		if w.status != status {
+			return fmt.Errorf("gofast: health check expected status %d, got %d", status, w.status)
+		}
+		return nil
+	}
+}
+
+// statusRecorder is a http.ResponseWriter that only
+// keeps the status code.
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (w *statusRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return ioutil.Discard.Write(p)
+}
+
+// Default values of HealthCheck
+const (
+	DefaultCheckTimeout = 5 * time.Second
+	DefaultEjectTime    = 30 * time.Second
+)
+
+// HealthCheck configures the health checking of the backends
+// of a Balancer. Backends are not picked while they are
+// unhealthy by the active checks or ejected by the passive
+// checks.
+type HealthCheck struct {
+	// Check is the active check run on every backend on every
+	// Interval. Active checks are disabled if Check is nil or
+	// Interval is zero.
+	Check    HealthCheckFunc
+	Interval time.Duration
+
+	// Timeout of each active check. If zero, DefaultCheckTimeout
+	// is used.
+	Timeout time.Duration
+
+	// Fall is the number of consecutive failed checks to mark a
+	// backend unhealthy, and Rise the number of consecutive
+	// passed checks to mark it healthy again. Both default to 1.
+	Fall int
+	Rise int
+
+	// MaxFails is the number of consecutive connect or protocol
+	// failures of requests to eject a backend, for EjectTime.
+	// The backend is re-admitted after that, and reported to
+	// OnChange if available again. Zero disables the
+	// passive checks. If EjectTime is zero, DefaultEjectTime is
+	// used.
+	MaxFails  int
+	EjectTime time.Duration
+
+	// OnChange, if not nil, is called when a backend becomes
+	// unavailable or available, with its new health.
+	OnChange func(health BackendHealth)
+}
+
+// BackendHealth is the health of a backend.
+type BackendHealth struct {
+	Name string
+
+	// Healthy is false if the backend failed the active checks
+	Healthy bool
+
+	// EjectedUntil is the time until the backend is ejected
+	// by the passive checks, or zero if not ejected
+	EjectedUntil time.Time
+
+	// Fails is the number of consecutive failures, of the active
+	// checks if unhealthy, or of requests otherwise
+	Fails int
+
+	// LastError is the error of the last failure, if any
+	LastError error
+
+	// LastCheck is the time of the last active check
+	LastCheck time.Time
+}
+
+// Available reports if the backend can be picked at the given time.
+func (h BackendHealth) Available(now time.Time) bool {
+	return h.Healthy && !now.Before(h.EjectedUntil)
+}
+
+// backendHealth is the health state of a backend, guarded
+// by the Balancer mutex
+type backendHealth struct {
+	unhealthy    bool
+	checkFails   int
+	checkPasses  int
+	fails        int
+	ejectedUntil time.Time
+	lastErr      error
+	lastCheck    time.Time
+}
+
+// available reports if the backend can be picked at the given time.
+func (b *backendState) available(now time.Time) bool {
+	return !b.health.unhealthy && !now.Before(b.health.ejectedUntil)
+}
+
+// admitted reports if the backend is available as reported to
+// OnChange. Unlike available, an ejected backend is not admitted
+// until it is re-admitted by readmit.
+func (b *backendState) admitted() bool {
+	return !b.health.unhealthy && b.health.ejectedUntil.IsZero()
+}
+
+// snapshot returns the exported health of the backend.
+func (b *backendState) snapshot() BackendHealth {
+	h := BackendHealth{
+		Name:         b.Name,
+		Healthy:      !b.health.unhealthy,
+		EjectedUntil: b.health.ejectedUntil,
+		Fails:        b.health.fails,
+		LastError:    b.health.lastErr,
+		LastCheck:    b.health.lastCheck,
+	}
+	if b.health.unhealthy {
+		h.Fails = b.health.checkFails
+	}
+	return h
+}
+
+// Health returns the health of all the backends.
+func (b *Balancer) Health() []BackendHealth {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	health := make([]BackendHealth, len(b.backends))
+	for i, backend := range b.backends {
+		health[i] = backend.snapshot()
+	}
+	return health
+}
+
+// SetHealthCheck sets the health checking of the backends, and
+// (re)starts the active checks if configured. The active checks
+// are stopped when the Balancer is closed.
+func (b *Balancer) SetHealthCheck(healthCheck HealthCheck) {
+	if healthCheck.Timeout == 0 {
+		healthCheck.Timeout = DefaultCheckTimeout
+	}
+	if healthCheck.EjectTime == 0 {
+		healthCheck.EjectTime = DefaultEjectTime
+	}
+	if healthCheck.Fall <= 0 {
+		healthCheck.Fall = 1
+	}
+	if healthCheck.Rise <= 0 {
+		healthCheck.Rise = 1
+	}
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return
+	}
+	stopped := b.stopHealthCheck()
+	b.healthCheck = healthCheck
+	if healthCheck.Check != nil && healthCheck.Interval > 0 {
+		b.stopChecker = make(chan struct{})
+		b.checkerDone = make(chan struct{})
+		go b.checker(healthCheck, b.stopChecker, b.checkerDone)
+	}
+	b.mutex.Unlock()
+
+	// the checker may be waiting for the mutex
+	if stopped != nil {
+		<-stopped
+	}
+}
+
+// stopHealthCheck stops the active checks, if running. It returns
+// a channel closed once the checks are stopped, or nil if not
+// running. Must be called with b.mutex locked, and the channel
+// waited with b.mutex unlocked.
+func (b *Balancer) stopHealthCheck() (stopped <-chan struct{}) {
+	if b.stopChecker == nil {
+		return nil
+	}
+	close(b.stopChecker)
+	stopped = b.checkerDone
+	b.stopChecker, b.checkerDone = nil, nil
+	return
+}
+
+// checker runs the active checks on every interval until stopped.
+func (b *Balancer) checker(healthCheck HealthCheck, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(healthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		b.checkAll(healthCheck, stop)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll runs the active check on all the backends concurrently.
+func (b *Balancer) checkAll(healthCheck HealthCheck, stop <-chan struct{}) {
+	b.mutex.Lock()
+	backends := make([]*backendState, len(b.backends))
+	copy(backends, b.backends)
+	b.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheck.Timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, backend := range backends {
+		wg.Add(1)
+		go func(backend *backendState) {
+			defer wg.Done()
+			err := healthCheck.Check(ctx, backend.Backend)
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			b.checked(backend, err)
+		}(backend)
+	}
+	wg.Wait()
+}
+
+// checked updates the health of a backend by the result
+// of an active check.
+func (b *Balancer) checked(backend *backendState, err error) {
+	var notify func()
+	defer func() {
+		if notify != nil {
+			notify()
+		}
+	}()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	wasAdmitted := backend.admitted()
+	h := &backend.health
+	h.lastCheck = time.Now()
+	if err != nil {
+		h.lastErr = err
+		h.checkPasses = 0
+		if h.checkFails++; h.checkFails >= b.healthCheck.Fall {
+			h.unhealthy = true
+		}
+	} else {
+		h.checkFails = 0
+		if h.checkPasses++; h.checkPasses >= b.healthCheck.Rise {
+			h.unhealthy = false
+		}
+	}
+	notify = b.changed(backend, wasAdmitted)
+}
+
+// passive reports if the passive checks are enabled.
+func (b *Balancer) passive() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.healthCheck.MaxFails > 0
+}
+
+// isFailure reports if the error of a request is a connect or
+// protocol failure of the backend.
+func isFailure(err error) bool {
+	switch err.(type) {
+	case *ConnError, *ProtocolError:
+		return true
+	}
+	return false
+}
+
+// report updates the health of a backend by the failure of
+// creating a client or of a request, or nil if succeeded.
+func (b *Balancer) report(backend *backendState, err error) {
+	var notify func()
+	defer func() {
+		if notify != nil {
+			notify()
+		}
+	}()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.healthCheck.MaxFails <= 0 {
+		return
+	}
+	wasAdmitted := backend.admitted()
+	h := &backend.health
+	if err == nil {
+		h.fails = 0
+		return
+	}
+	h.lastErr = err
+	if h.fails++; h.fails >= b.healthCheck.MaxFails {
+		h.fails = 0
+		until := time.Now().Add(b.healthCheck.EjectTime)
+		h.ejectedUntil = until
+		time.AfterFunc(b.healthCheck.EjectTime, func() {
+			b.readmit(backend, until)
+		})
+	}
+	notify = b.changed(backend, wasAdmitted)
+}
+
+// readmit ends the ejection of a backend until the given time,
+// if it is still in the Balancer and not ejected again.
+func (b *Balancer) readmit(backend *backendState, until time.Time) {
+	var notify func()
+	defer func() {
+		if notify != nil {
+			notify()
+		}
+	}()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if i := b.find(backend.Name); i < 0 || b.backends[i] != backend {
+		return
+	}
+	if !backend.health.ejectedUntil.Equal(until) {
+		return
+	}
+	backend.health.ejectedUntil = time.Time{}
+	notify = b.changed(backend, false)
+}
+
+// changed returns the call of OnChange if the backend has become
+// admitted or not, or nil. Must be called with b.mutex locked.
+func (b *Balancer) changed(backend *backendState, wasAdmitted bool) (notify func()) {
+	onChange := b.healthCheck.OnChange
+	if onChange == nil || wasAdmitted == backend.admitted() {
+		return nil
+	}
+	health := backend.snapshot()
+	return func() {
+		onChange(health)
+	}
+}
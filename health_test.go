@@ -0,0 +1,226 @@
+package gofast_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yookoala/gofast"
+)
+
+// newFailingBackend returns a backend that fails to connect
+func newFailingBackend(name string) gofast.Backend {
+	return gofast.Backend{
+		Name: name,
+		Pool: gofast.NewPool(func(ctx context.Context) (gofast.Client, error) {
+			return nil, fmt.Errorf("%s: connection refused", name)
+		}, gofast.PoolConfig{DialBackoff: -1}),
+	}
+}
+
+func TestBalancer_passiveHealthCheck(t *testing.T) {
+	b, err := gofast.NewBalancer(gofast.RoundRobin,
+		newFailingBackend("bad"),
+		newTestBackend("good", 1),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer b.Close()
+
+	var mutex sync.Mutex
+	var changes []gofast.BackendHealth
+	b.SetHealthCheck(gofast.HealthCheck{
+		MaxFails:  2,
+		EjectTime: 50 * time.Millisecond,
+		OnChange: func(health gofast.BackendHealth) {
+			mutex.Lock()
+			changes = append(changes, health)
+			mutex.Unlock()
+		},
+	})
+
+	// the bad backend is ejected after 2 failures
+	fails := 0
+	for i := 0; i < 10; i++ {
+		c, err := b.CreateClient()
+		if err != nil {
+			fails++
+			continue
+		}
+		c.Close()
+	}
+	if want, have := 2, fails; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	health := b.Health()
+	if want, have := "bad", health[0].Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if health[0].Available(time.Now()) {
+		t.Errorf("expected the bad backend to be ejected")
+	}
+	if !health[1].Available(time.Now()) {
+		t.Errorf("expected the good backend to be available")
+	}
+	mutex.Lock()
+	if want, have := 1, len(changes); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	} else if want, have := "bad", changes[0].Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	mutex.Unlock()
+
+	// re-admitted after the cool-down, and reported
+	time.Sleep(60 * time.Millisecond)
+	if !b.Health()[0].Available(time.Now()) {
+		t.Errorf("expected the bad backend to be re-admitted")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if want, have := 2, len(changes); want != have {
+		t.Fatalf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "bad", changes[1].Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if !changes[1].Available(time.Now()) {
+		t.Errorf("expected the re-admission to be reported")
+	}
+}
+
+func TestBalancer_activeHealthCheck(t *testing.T) {
+	b, err := gofast.NewBalancer(gofast.RoundRobin,
+		newTestBackend("a", 1),
+		newTestBackend("b", 1),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer b.Close()
+
+	var down int32 = 1
+	b.SetHealthCheck(gofast.HealthCheck{
+		Interval: 10 * time.Millisecond,
+		Check: func(ctx context.Context, backend gofast.Backend) error {
+			if backend.Name == "a" && atomic.LoadInt32(&down) == 1 {
+				return fmt.Errorf("a is down")
+			}
+			return nil
+		},
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	// only b is picked while a is down
+	for i := 0; i < 4; i++ {
+		name, c := pickBackend(t, b, context.Background())
+		c.Close()
+		if want, have := "b", name; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	}
+	if b.Health()[0].Healthy {
+		t.Errorf("expected a to be unhealthy")
+	}
+
+	// a is picked again after it passed the check
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(50 * time.Millisecond)
+	count := map[string]int{}
+	for i := 0; i < 4; i++ {
+		name, c := pickBackend(t, b, context.Background())
+		c.Close()
+		count[name]++
+	}
+	if want, have := 2, count["a"]; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestHealthCheckFunc(t *testing.T) {
+	srv := &gofast.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/status" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, "ok")
+		}),
+	}
+	l, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	backend := gofast.NewBackend("tcp", l.Addr().String(), 1, gofast.PoolConfig{})
+	defer backend.Pool.Close()
+
+	newRequest := func(uri string) func() *gofast.Request {
+		return func() *gofast.Request {
+			req := gofast.NewRequest(nil)
+			req.Params.Set("REQUEST_METHOD", "GET")
+			req.Params.Set("SERVER_PROTOCOL", "HTTP/1.1")
+			req.Params.Set("REQUEST_URI", uri)
+			return req
+		}
+	}
+
+	ctx := context.Background()
+	if err := gofast.CheckDial(ctx, backend); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := gofast.CheckGetValues(ctx, backend); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := gofast.CheckScript(newRequest("/status"), http.StatusOK)(ctx, backend); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := gofast.CheckScript(newRequest("/other"), http.StatusOK)(ctx, backend); err == nil {
+		t.Errorf("expected error checking unexpected status")
+	}
+
+	// the backend is down
+	srv.Close()
+	l.Close()
+	time.Sleep(10 * time.Millisecond)
+	if err := gofast.CheckDial(ctx, backend); err == nil {
+		t.Errorf("expected error checking a closed backend")
+	}
+}
+
+func TestBalancer_setHealthCheckConcurrent(t *testing.T) {
+	b, err := gofast.NewBalancer(gofast.RoundRobin, newTestBackend("a", 1))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer b.Close()
+
+	var checks int64
+	healthCheck := gofast.HealthCheck{
+		Interval: time.Millisecond,
+		Check: func(ctx context.Context, backend gofast.Backend) error {
+			atomic.AddInt64(&checks, 1)
+			time.Sleep(time.Millisecond)
+			return nil
+		},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.SetHealthCheck(healthCheck)
+		}()
+	}
+	wg.Wait()
+
+	// no active checks are left running
+	b.SetHealthCheck(gofast.HealthCheck{})
+	stopped := atomic.LoadInt64(&checks)
+	time.Sleep(20 * time.Millisecond)
+	if want, have := stopped, atomic.LoadInt64(&checks); want != have {
+		t.Errorf("expected %#v checks, got %#v", want, have)
+	}
+}
@@ -2,8 +2,11 @@ package gofast
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // Handler is implements http.Handler and provide logger changing method.
@@ -12,22 +15,70 @@ type Handler interface {
 	SetLogger(logger *log.Logger)
 }
 
+// HandlerOption configures the Handler of NewHandler
+// and NewContextHandler.
+type HandlerOption func(h *defaultHandler)
+
+// Timeouts are the timeouts of each phase of a request by the Handler,
+// like fastcgi_connect_timeout, fastcgi_send_timeout and
+// fastcgi_read_timeout of nginx. Zero means no timeout.
+//
+// If exceeded, the Handler responds with 504 Gateway Timeout.
+type Timeouts struct {
+	// Connect limits the time to get a client from the
+	// ClientFactory (e.g. dialing the application). It is only
+	// enforced with a ContextClientFactory that respects the
+	// context, or by leaving a blocking ClientFactory behind.
+	Connect time.Duration
+
+	// Send limits the inactivity of sending the request to
+	// the application. See Request.SendTimeout.
+	Send time.Duration
+
+	// Read limits the inactivity of reading the response from
+	// the application. See Request.ReadTimeout.
+	Read time.Duration
+}
+
+// WithTimeouts sets the timeouts of each phase of a request.
+func WithTimeouts(timeouts Timeouts) HandlerOption {
+	return func(h *defaultHandler) {
+		h.timeouts = timeouts
+	}
+}
+
 // NewHandler returns the default Handler implementation. This default Handler
 // act as the "web server" component in fastcgi specification, which connects
 // fastcgi "application" through the network/address and passthrough I/O as
 // specified.
-func NewHandler(sessionHandler SessionHandler, clientFactory ClientFactory) Handler {
-	return &defaultHandler{
+func NewHandler(sessionHandler SessionHandler, clientFactory ClientFactory, options ...HandlerOption) Handler {
+	return NewContextHandler(sessionHandler, clientFactory.ContextClientFactory(), options...)
+}
+
+// NewContextHandler returns the default Handler implementation, like
+// NewHandler, with a ContextClientFactory. The factory is called with
+// the context of the http request, so creating the client (e.g. dialing
+// the application) is canceled with the request.
+func NewContextHandler(sessionHandler SessionHandler, clientFactory ContextClientFactory, options ...HandlerOption) Handler {
+	h := &defaultHandler{
 		sessionHandler: sessionHandler,
 		newClient:      clientFactory,
 	}
+	for _, option := range options {
+		option(h)
+	}
+	return h
 }
 
 // defaultHandler implements Handler
 type defaultHandler struct {
 	sessionHandler SessionHandler
-	newClient      ClientFactory
+	newClient      ContextClientFactory
 	logger         *log.Logger
+	timeouts       Timeouts
+	redirect       LocalRedirect
+	sendfile       Sendfile
+	headerLimits   HeaderLimits
 }
 
 // SetLogger implements Handler
@@ -35,47 +86,134 @@ func (h *defaultHandler) SetLogger(logger *log.Logger) {
 	h.logger = logger
 }
 
+// connect gets a client from the factory within the connect timeout.
+func (h *defaultHandler) connect(ctx context.Context) (c Client, err error) {
+	if h.timeouts.Connect > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeouts.Connect)
+		defer cancel()
+	}
+	if c, err = h.newClient(ctx); err != nil && ctx.Err() != nil {
+		err = ctxError(ctx)
+	}
+	return
+}
+
+// logf logs with the logger set by SetLogger, or the
+// standard logger if none is set.
+func (h *defaultHandler) logf(format string, v ...interface{}) {
+	if h.logger != nil {
+		h.logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
 // ServeHTTP implements http.Handler
 func (h *defaultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// TODO: separate dial logic to pool client / connection
-	c, err := h.newClient()
+	c, err := h.connect(r.Context())
 	if err != nil {
-		http.Error(w, "failed to connect to FastCGI application", http.StatusBadGateway)
-		log.Printf("gofast: unable to connect to FastCGI application. %s",
+		httpError(w, "failed to connect to FastCGI application", err, ErrorStatus(err))
+		h.logf("gofast: unable to connect to FastCGI application. %s",
 			err.Error())
 		return
 	}
 
 	// defer closing with error reporting
 	defer func() {
-		if c == nil {
-			return
-		}
-
-		// signal to close the client
-		// or the pool to return the client
-		if err = c.Close(); err != nil {
-			log.Printf("gofast: error closing client: %s",
-				err.Error())
+		if c != nil {
+			h.closeClient(c)
 		}
 	}()
 
 	// handle the session
-	resp, err := h.sessionHandler(c, NewRequest(r))
+	req := NewRequest(r)
+	req.SendTimeout = h.timeouts.Send
+	req.ReadTimeout = h.timeouts.Read
+	setRedirectParams(req)
+	resp, err := h.sessionHandler(c, req)
 	if err != nil {
-		http.Error(w, "failed to process request", http.StatusInternalServerError)
-		log.Printf("gofast: unable to process request %s",
+		httpError(w, "failed to process request", err, http.StatusInternalServerError)
+		h.logf("gofast: unable to process request %s",
 			err.Error())
 		return
 	}
+	resp.followLocal = h.redirect.MaxDepth > 0
+	resp.fileHeaders = h.sendfile.headers()
+	resp.headerLimits = h.headerLimits
 	errBuffer := new(bytes.Buffer)
-	if err = resp.WriteTo(w, errBuffer); err != nil {
-		log.Printf("gofast: problem writing error buffer to response - %s", err)
+	err = resp.WriteTo(w, errBuffer)
+
+	// report errors of the request, separated from
+	// the application error stream
+	respErr := resp.Err()
+	if _, ok := err.(*HeaderError); ok {
+		h.logf("gofast: bad response from application: %s", err)
+	} else if err != nil && err != respErr {
+		h.logf("gofast: problem writing error buffer to response - %s", err)
+	}
+	if er, ok := resp.EndRequest(); ok && er.ProtocolStatus != StatusRequestComplete {
+		h.logf("gofast: request rejected by application with %s (app status %d)",
+			er.ProtocolStatus, er.AppStatus)
+	} else if respErr != nil {
+		h.logf("gofast: request failed: %s", respErr)
 	}
 
 	if errBuffer.Len() > 0 {
-		log.Printf("gofast: error stream from application process %s",
+		h.logf("gofast: error stream from application process %s",
 			errBuffer.String())
 	}
+
+	// release the client before serving the file or
+	// the redirected request
+	switch {
+	case resp.file != "":
+		h.closeClient(c)
+		c = nil
+		h.serveFile(w, r, resp.fileHeader, resp.file)
+	case resp.location != "":
+		h.closeClient(c)
+		c = nil
+		h.localRedirect(w, r, req, resp.location)
+	}
+}
+
+// closeClient closes the client, or returns it to the pool,
+// with error reporting.
+func (h *defaultHandler) closeClient(c Client) {
+	if err := c.Close(); err != nil {
+		h.logf("gofast: error closing client: %s",
+			err.Error())
+	}
+}
+
+// httpError responds the error of the request. The errors of
+// the request handling respond the status code of ErrorStatus,
+// other errors respond the given status code.
+func httpError(w http.ResponseWriter, msg string, err error, status int) {
+	if oerr, ok := err.(*CircuitOpenError); ok {
+		// round up to the next second
+		w.Header().Set("Retry-After", strconv.Itoa(int((oerr.RetryAfter+time.Second-1)/time.Second)))
+	}
+	if isRequestError(err) {
+		status = ErrorStatus(err)
+	}
+	http.Error(w, msg, status)
+}
+
+// isRequestError reports if the error is of the request handling
+// (e.g. timeout, overloaded application, broken connection), not
+// of the session handler (e.g. invalid path).
+func isRequestError(err error) bool {
+	switch err.(type) {
+	case *CircuitOpenError, *ConnError, *ProtocolError:
+		return true
+	}
+	switch err {
+	case ErrTimeout, ErrOverloaded, ErrQueueFull, ErrQueueTimeout:
+		return true
+	}
+	return false
 }
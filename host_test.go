@@ -1,11 +1,19 @@
 package gofast_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/yookoala/gofast"
 )
@@ -82,3 +90,422 @@ func TestHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestHandler_unknownRole(t *testing.T) {
+
+	// net/http/fcgi only implements responder, and
+	// rejects other roles with FCGI_UNKNOWN_ROLE
+	p, err := newAppServer("test.handler.sock", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected access to the FastCGI application")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	defer p.Close()
+
+	logs := new(bytes.Buffer)
+	h := gofast.NewHandler(
+		func(client gofast.Client, req *gofast.Request) (*gofast.ResponsePipe, error) {
+			req.Role = gofast.RoleAuthorizer
+			return client.Do(req)
+		},
+		gofast.SimpleClientFactory(
+			gofast.SimpleConnFactory(p.Network(), p.Address()),
+		),
+	)
+	h.SetLogger(log.New(logs, "", 0))
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/add", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	h.ServeHTTP(w, r)
+
+	if want, have := http.StatusInternalServerError, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "gofast: request rejected by application with FCGI_UNKNOWN_ROLE", logs.String(); !strings.Contains(have, want) {
+		t.Errorf("expected log to contain %#v, got %#v", want, have)
+	}
+}
+
+func TestHandler_overloaded(t *testing.T) {
+
+	// dummy application that rejects all requests
+	// with FCGI_OVERLOADED
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		h := make([]byte, 8)
+		if _, err := io.ReadFull(conn, h); err != nil {
+			return
+		}
+		conn.Write([]byte{
+			1, 3, h[2], h[3], 0, 8, 0, 0, // FCGI_END_REQUEST header
+			0, 0, 0, 0, 2, 0, 0, 0, // FCGI_OVERLOADED
+		})
+		ioutil.ReadAll(conn)
+	}()
+
+	logs := new(bytes.Buffer)
+	h := gofast.NewHandler(
+		gofast.BasicSession,
+		gofast.SimpleClientFactory(
+			gofast.SimpleConnFactory("tcp", l.Addr().String()),
+		),
+	)
+	h.SetLogger(log.New(logs, "", 0))
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/add", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %#v", err.Error())
+	}
+	h.ServeHTTP(w, r)
+
+	if want, have := http.StatusServiceUnavailable, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "gofast: request rejected by application with FCGI_OVERLOADED", logs.String(); !strings.Contains(have, want) {
+		t.Errorf("expected log to contain %#v, got %#v", want, have)
+	}
+}
+
+func TestHandler_requestErrors(t *testing.T) {
+
+	// dummy application that reads the begin request
+	// record, then replies with the given bytes
+	newApp := func(reply []byte) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %#v", err.Error())
+		}
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			h := make([]byte, 16)
+			if _, err := io.ReadFull(conn, h); err != nil {
+				return
+			}
+			conn.Write(reply)
+		}()
+		return l
+	}
+
+	tests := []struct {
+		desc  string
+		reply []byte
+		code  int
+		check func(err error) bool
+	}{
+		{
+			desc:  "connection reset",
+			reply: nil,
+			code:  http.StatusBadGateway,
+			check: func(err error) bool {
+				_, ok := err.(*gofast.ConnError)
+				return ok
+			},
+		},
+		{
+			desc:  "invalid version",
+			reply: []byte{2, 6, 0, 1, 0, 0, 0, 0},
+			code:  http.StatusBadGateway,
+			check: func(err error) bool {
+				_, ok := err.(*gofast.ProtocolError)
+				return ok
+			},
+		},
+	}
+
+	for _, test := range tests {
+		l := newApp(test.reply)
+		defer l.Close()
+
+		c, err := gofast.SimpleClientFactory(
+			gofast.SimpleConnFactory("tcp", l.Addr().String()),
+		)()
+		if err != nil {
+			t.Fatalf("unexpected error: %#v", err.Error())
+		}
+		defer c.Close()
+
+		r, err := http.NewRequest("GET", "/add", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %#v", err.Error())
+		}
+		resp, err := c.Do(gofast.NewRequest(r))
+		if err != nil {
+			t.Fatalf("unexpected error: %#v", err.Error())
+		}
+		w, errBuffer := httptest.NewRecorder(), new(bytes.Buffer)
+		resp.WriteTo(w, errBuffer)
+
+		if want, have := test.code, w.Code; want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.desc, want, have)
+		}
+		if err := resp.Err(); !test.check(err) {
+			t.Errorf("%s: unexpected error %#v", test.desc, err)
+		}
+		if want, have := "", errBuffer.String(); want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+}
+
+func TestHandler_sessionErrors(t *testing.T) {
+	tests := []struct {
+		desc string
+		err  error
+		code int
+	}{
+		{
+			desc: "session error",
+			err:  fmt.Errorf("access path outside of filesystem docroot"),
+			code: http.StatusInternalServerError,
+		},
+		{
+			desc: "overloaded",
+			err:  gofast.ErrOverloaded,
+			code: http.StatusServiceUnavailable,
+		},
+		{
+			desc: "timeout",
+			err:  gofast.ErrTimeout,
+			code: http.StatusGatewayTimeout,
+		},
+		{
+			desc: "connection broken",
+			err:  &gofast.ConnError{Op: "write", Err: io.ErrClosedPipe},
+			code: http.StatusBadGateway,
+		},
+	}
+
+	for _, test := range tests {
+		h := gofast.NewContextHandler(
+			func(client gofast.Client, req *gofast.Request) (*gofast.ResponsePipe, error) {
+				return nil, test.err
+			},
+			nopClientFactory,
+		)
+		h.SetLogger(log.New(ioutil.Discard, "", 0))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if want, have := test.code, w.Code; want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+}
+
+func TestHandler_timeouts(t *testing.T) {
+
+	// dummy application that accepts a connection but never
+	// replies. If stop is not nil, it does not even read the
+	// request until stop is closed. Returns a channel closed
+	// when the web server closes the connection.
+	newApp := func(stop <-chan struct{}) (l net.Listener, closed <-chan struct{}) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %#v", err.Error())
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if stop != nil {
+				<-stop
+			}
+			io.Copy(ioutil.Discard, conn)
+		}()
+		return l, done
+	}
+
+	t.Run("read", func(t *testing.T) {
+		l, closed := newApp(nil)
+		defer l.Close()
+
+		h := gofast.NewHandler(
+			gofast.BasicSession,
+			gofast.SimpleClientFactory(gofast.SimpleConnFactory("tcp", l.Addr().String())),
+			gofast.WithTimeouts(gofast.Timeouts{Read: 50 * time.Millisecond}),
+		)
+		h.SetLogger(log.New(ioutil.Discard, "", 0))
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if want, have := http.StatusGatewayTimeout, w.Code; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+
+		// the connection is closed to abort the request
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Errorf("expected the connection to be closed")
+		}
+	})
+
+	t.Run("send", func(t *testing.T) {
+		stop := make(chan struct{})
+		l, _ := newApp(stop)
+		defer l.Close()
+		defer close(stop)
+
+		h := gofast.NewHandler(
+			gofast.BasicSession,
+			gofast.SimpleClientFactory(gofast.SimpleConnFactory("tcp", l.Addr().String())),
+			gofast.WithTimeouts(gofast.Timeouts{Send: 50 * time.Millisecond}),
+		)
+		h.SetLogger(log.New(ioutil.Discard, "", 0))
+
+		// a body large enough to fill the socket buffers
+		body := bytes.NewReader(make([]byte, 64<<20))
+		r, _ := http.NewRequest("POST", "/", body)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if want, have := http.StatusGatewayTimeout, w.Code; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	})
+
+	t.Run("send begin request", func(t *testing.T) {
+		// the application end of the pipe never reads, so
+		// even FCGI_BEGIN_REQUEST cannot be written
+		conn, app := net.Pipe()
+		defer app.Close()
+
+		h := gofast.NewHandler(
+			gofast.BasicSession,
+			gofast.SimpleClientFactory(func() (net.Conn, error) {
+				return conn, nil
+			}),
+			gofast.WithTimeouts(gofast.Timeouts{Send: 50 * time.Millisecond}),
+		)
+		h.SetLogger(log.New(ioutil.Discard, "", 0))
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if want, have := http.StatusGatewayTimeout, w.Code; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		h := gofast.NewContextHandler(
+			gofast.BasicSession,
+			func(ctx context.Context) (gofast.Client, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			gofast.WithTimeouts(gofast.Timeouts{Connect: 50 * time.Millisecond}),
+		)
+		h.SetLogger(log.New(ioutil.Discard, "", 0))
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if want, have := http.StatusGatewayTimeout, w.Code; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	})
+}
+
+// flushRecorder is a ResponseRecorder that reports
+// the body written on every flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan string
+}
+
+func (w *flushRecorder) Flush() {
+	w.ResponseRecorder.Flush()
+	w.flushed <- w.Body.String()
+}
+
+func TestHandler_flush(t *testing.T) {
+	next := make(chan struct{})
+	srv := &gofast.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/events" {
+				w.Header().Set("Content-Type", "text/event-stream")
+			} else {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("X-Accel-Buffering", r.URL.Query().Get("buffering"))
+			}
+			fmt.Fprintf(w, "data: 1\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-time.After(100 * time.Millisecond):
+			}
+			fmt.Fprintf(w, "data: 2\n\n")
+		}),
+	}
+	l, _ := newServerApp(t, srv)
+	defer srv.Close()
+	h := newServerHandler(l)
+
+	tests := []struct {
+		uri      string
+		streamed bool
+	}{
+		{"/events", true},
+		{"/text?buffering=no", true},
+		{"/text?buffering=yes", false},
+		{"/text", false},
+	}
+	for _, test := range tests {
+		w := &flushRecorder{httptest.NewRecorder(), make(chan string, 10)}
+		done := make(chan struct{})
+		go func() {
+			h.ServeHTTP(w, httptest.NewRequest("GET", test.uri, nil))
+			close(done)
+		}()
+
+		// the first event is received before the second is written
+		streamed := false
+	wait:
+		for {
+			select {
+			case body := <-w.flushed:
+				if body == "data: 1\n\n" {
+					streamed = true
+					next <- struct{}{}
+					break wait
+				}
+			case <-done:
+				break wait
+			}
+		}
+		<-done
+
+		if want, have := test.streamed, streamed; want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.uri, want, have)
+		}
+		if want, have := "data: 1\n\ndata: 2\n\n", w.Body.String(); want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.uri, want, have)
+		}
+		if have := w.Header().Get("X-Accel-Buffering"); have != "" {
+			t.Errorf("%s: expected the header stripped, got %#v", test.uri, have)
+		}
+	}
+}
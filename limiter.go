@@ -0,0 +1,293 @@
+package gofast
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Errors of Limiter
+var (
+	// ErrQueueFull is returned by Limiter if the request cannot
+	// be queued as the queue is full.
+	ErrQueueFull = errors.New("gofast: request queue full")
+
+	// ErrQueueTimeout is returned by Limiter if the request has
+	// waited in the queue longer than the maximum wait time.
+	ErrQueueTimeout = errors.New("gofast: request queue wait timeout")
+)
+
+// LimitConfig configures a Limiter.
+type LimitConfig struct {
+	// MaxRequests is the maximum number of requests in flight.
+	// If zero, FCGI_MAX_REQS of the application is used (e.g.
+	// pm.max_children of php-fpm), queried in the background with a
+	// client of the factory. Until it is known, the requests are not
+	// limited. If negative, or if the application does not report
+	// it, the requests are not limited.
+	MaxRequests int
+
+	// MaxQueue is the maximum number of requests waiting for
+	// the requests in flight. Requests beyond that fail with
+	// ErrQueueFull. If zero, requests do not wait.
+	MaxQueue int
+
+	// MaxWait is the maximum time a request waits in the queue
+	// before it fails with ErrQueueTimeout. Zero means no limit,
+	// other than the context of the request.
+	MaxWait time.Duration
+}
+
+// LimitStats are the statistics of a Limiter, e.g. for autoscaling.
+type LimitStats struct {
+	MaxRequests int // limit of requests in flight, or 0 if unlimited
+
+	InFlight int // number of requests in flight
+	Queued   int // number of requests waiting in the queue
+
+	// Waiting in the queue
+	WaitCount    int64         // total number of requests waited
+	WaitDuration time.Duration // total time waited
+	MaxWaited    time.Duration // longest time waited
+
+	// Failed requests
+	QueueFullCount    int64 // failed with ErrQueueFull
+	QueueTimeoutCount int64 // failed with ErrQueueTimeout
+}
+
+// Limiter limits the number of requests in flight to a FastCGI
+// application. Excess requests wait in a FIFO queue. Each request
+// holds its slot from creating the client until the client is
+// closed.
+//
+// The limit is of the application. Put the Limiter outside of the
+// ClientPool of the application (i.e. on its CreateClientContext),
+// not in the factory of the pool, or the slots are held by the
+// pooled connections instead of the requests. For the backends of a
+// Balancer, set Backend.Limit instead.
+type Limiter struct {
+	factory ContextClientFactory
+	config  LimitConfig
+
+	// mutex guards all the fields below
+	mutex     sync.Mutex
+	limit     int // 0 if not yet known, negative if unlimited
+	probing   bool
+	nextProbe time.Time
+	inFlight  int
+	queue     []chan struct{}
+
+	waitCount         int64
+	waitDuration      time.Duration
+	maxWaited         time.Duration
+	queueFullCount    int64
+	queueTimeoutCount int64
+}
+
+// NewLimiter creates a Limiter of the factory.
+func NewLimiter(factory ContextClientFactory, config LimitConfig) *Limiter {
+	return &Limiter{
+		factory: factory,
+		config:  config,
+		limit:   config.MaxRequests,
+	}
+}
+
+// Stats returns the statistics of the limiter.
+func (l *Limiter) Stats() LimitStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	stats := LimitStats{
+		InFlight: l.inFlight,
+		Queued:   len(l.queue),
+
+		WaitCount:    l.waitCount,
+		WaitDuration: l.waitDuration,
+		MaxWaited:    l.maxWaited,
+
+		QueueFullCount:    l.queueFullCount,
+		QueueTimeoutCount: l.queueTimeoutCount,
+	}
+	if l.limit > 0 {
+		stats.MaxRequests = l.limit
+	}
+	return stats
+}
+
+// CreateClient implements ClientFactory
+func (l *Limiter) CreateClient() (Client, error) {
+	return l.CreateClientContext(context.Background())
+}
+
+// CreateClientContext implements ContextClientFactory. It waits for
+// a slot of request before creating the client from the factory.
+func (l *Limiter) CreateClientContext(ctx context.Context) (Client, error) {
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	c, err := l.factory(ctx)
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	l.probe()
+	return &limitedClient{Client: c, limiter: l}, nil
+}
+
+// acquire takes a slot of request, or waits in the queue for one.
+func (l *Limiter) acquire(ctx context.Context) error {
+	l.mutex.Lock()
+	if l.limit <= 0 || (l.inFlight < l.limit && len(l.queue) == 0) {
+		l.inFlight++
+		l.mutex.Unlock()
+		return nil
+	}
+	if len(l.queue) >= l.config.MaxQueue {
+		l.queueFullCount++
+		l.mutex.Unlock()
+		return ErrQueueFull
+	}
+	wait := make(chan struct{}, 1)
+	l.queue = append(l.queue, wait)
+	l.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if l.config.MaxWait > 0 {
+		timer := time.NewTimer(l.config.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	start := time.Now()
+	var err error
+	select {
+	case <-wait:
+	case <-ctx.Done():
+		err = ctxError(ctx)
+	case <-timeout:
+		err = ErrQueueTimeout
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err != nil {
+		if l.removeWaiter(wait) {
+			if err == ErrQueueTimeout {
+				l.queueTimeoutCount++
+			}
+			return err
+		}
+		// handed a slot meanwhile
+	}
+	waited := time.Since(start)
+	l.waitCount++
+	l.waitDuration += waited
+	if waited > l.maxWaited {
+		l.maxWaited = waited
+	}
+	return nil
+}
+
+// removeWaiter removes the waiter from the queue. It reports false
+// if the waiter is not in the queue. Must be called with l.mutex
+// locked.
+func (l *Limiter) removeWaiter(wait chan struct{}) bool {
+	for i, w := range l.queue {
+		if w == wait {
+			l.queue = append(l.queue[:i:i], l.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// release gives the slot of a request to the first waiter
+// in the queue, or frees it.
+func (l *Limiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.queue) > 0 && l.inFlight <= l.limit {
+		wait := l.queue[0]
+		l.queue = l.queue[1:]
+		wait <- struct{}{}
+		return
+	}
+	l.inFlight--
+}
+
+// probeBackoff is the time to wait before querying FCGI_MAX_REQS
+// again, if the query failed (e.g. the connection is closed).
+const probeBackoff = 5 * time.Second
+
+// probe sets the limit by FCGI_MAX_REQS of the application in the
+// background, if not configured nor known yet. It queries with a
+// client of its own, as the client of the request may be closed
+// meanwhile. If the application does not answer in time, the
+// requests are not limited.
+func (l *Limiter) probe() {
+	l.mutex.Lock()
+	if l.limit != 0 || l.probing || time.Now().Before(l.nextProbe) {
+		l.mutex.Unlock()
+		return
+	}
+	l.probing = true
+	l.mutex.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		defer cancel()
+		c, err := l.factory(ctx)
+		var v Values
+		if err == nil {
+			v, err = clientValues(ctx, c)
+			c.Close()
+		}
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.probing = false
+		switch {
+		case err == nil && v.MaxReqs > 0:
+			l.limit = v.MaxReqs
+		case err == nil || err == errValuesUnsupported || ctx.Err() != nil:
+			l.limit = -1
+		default:
+			l.nextProbe = time.Now().Add(probeBackoff)
+		}
+	}()
+}
+
+// valuesGetter is implemented by the clients which can query
+// FCGI_GET_VALUES on their connection. The clients wrapping
+// another client implement it with clientValues.
+type valuesGetter interface {
+	getValues(ctx context.Context) (Values, error)
+}
+
+// clientValues queries FCGI_GET_VALUES on the connection of the
+// client, if the client supports it.
+func clientValues(ctx context.Context, c Client) (Values, error) {
+	if c, ok := c.(valuesGetter); ok {
+		return c.getValues(ctx)
+	}
+	return Values{}, errValuesUnsupported
+}
+
+// limitedClient is a client created by a Limiter
+type limitedClient struct {
+	Client
+	limiter *Limiter
+	once    sync.Once
+}
+
+// getValues implements valuesGetter
+func (c *limitedClient) getValues(ctx context.Context) (Values, error) {
+	return clientValues(ctx, c.Client)
+}
+
+// Close implements Client.Close. It frees the slot of request.
+func (c *limitedClient) Close() error {
+	c.once.Do(c.limiter.release)
+	return c.Client.Close()
+}
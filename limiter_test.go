@@ -0,0 +1,189 @@
+package gofast_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yookoala/gofast"
+)
+
+// nopClientFactory creates clients that do nothing
+func nopClientFactory(ctx context.Context) (gofast.Client, error) {
+	return gofast.ClientFunc(nil), nil
+}
+
+func TestLimiter_queue(t *testing.T) {
+	l := gofast.NewLimiter(nopClientFactory, gofast.LimitConfig{
+		MaxRequests: 2,
+		MaxQueue:    1,
+		MaxWait:     50 * time.Millisecond,
+	})
+
+	var clients []gofast.Client
+	for i := 0; i < 2; i++ {
+		c, err := l.CreateClient()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		clients = append(clients, c)
+	}
+
+	// the third waits in the queue, the fourth overflows
+	waited := make(chan error, 1)
+	go func() {
+		c, err := l.CreateClient()
+		if err == nil {
+			clients[0] = c
+		}
+		waited <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if want, have := 1, l.Stats().Queued; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if _, err := l.CreateClient(); err != gofast.ErrQueueFull {
+		t.Errorf("expected %#v, got %#v", gofast.ErrQueueFull, err)
+	}
+
+	// the waiting one takes the slot of a closed client
+	clients[1].Close()
+	if err := <-waited; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// timeout in the queue
+	if _, err := l.CreateClient(); err != gofast.ErrQueueTimeout {
+		t.Errorf("expected %#v, got %#v", gofast.ErrQueueTimeout, err)
+	}
+
+	stats := l.Stats()
+	if want, have := 2, stats.MaxRequests; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := 2, stats.InFlight; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := int64(1), stats.WaitCount; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := int64(1), stats.QueueFullCount; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := int64(1), stats.QueueTimeoutCount; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if stats.WaitDuration <= 0 {
+		t.Errorf("expected wait duration, got %s", stats.WaitDuration)
+	}
+}
+
+func TestLimiter_maxReqs(t *testing.T) {
+	srv := &gofast.Server{MaxReqs: 3}
+	app, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	factory := gofast.SimpleContextClientFactory(gofast.SimpleContextConnFactory("tcp", app.Addr().String()))
+	pool := gofast.NewPool(factory, gofast.PoolConfig{})
+	defer pool.Close()
+
+	// also queried through the clients wrapping the connection
+	for _, factory := range []gofast.ContextClientFactory{factory, pool.CreateClientContext} {
+		l := gofast.NewLimiter(factory, gofast.LimitConfig{})
+		if want, have := 0, l.Stats().MaxRequests; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		c, err := l.CreateClient()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		// queried in the background
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			if l.Stats().MaxRequests != 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if want, have := 3, l.Stats().MaxRequests; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		c.Close()
+	}
+}
+
+func TestLimiter_maxReqsClosed(t *testing.T) {
+	srv := &gofast.Server{MaxReqs: 3}
+	app, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	// the client of the request is closed before
+	// the query in the background is done
+	l := gofast.NewLimiter(
+		gofast.SimpleContextClientFactory(gofast.SimpleContextConnFactory("tcp", app.Addr().String())),
+		gofast.LimitConfig{},
+	)
+	c, err := l.CreateClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.Close()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if l.Stats().MaxRequests != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if want, have := 3, l.Stats().MaxRequests; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestLimiter_maxReqsTimeout(t *testing.T) {
+	// the application never answers FCGI_GET_VALUES
+	app, _ := newRawApp(t, func(conn net.Conn) {
+		io.Copy(ioutil.Discard, conn)
+	})
+	defer app.Close()
+
+	l := gofast.NewLimiter(
+		gofast.SimpleContextClientFactory(gofast.SimpleContextConnFactory("tcp", app.Addr().String())),
+		gofast.LimitConfig{},
+	)
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		c, err := l.CreateClient()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer c.Close()
+		if waited := time.Since(start); waited > 100*time.Millisecond {
+			t.Errorf("expected not to wait for the query, waited %s", waited)
+		}
+	}
+	if want, have := 3, l.Stats().InFlight; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestLimiter_handler(t *testing.T) {
+	l := gofast.NewLimiter(nopClientFactory, gofast.LimitConfig{MaxRequests: 1})
+	c, err := l.CreateClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	h := gofast.NewContextHandler(gofast.BasicSession, l.CreateClientContext)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if want, have := http.StatusServiceUnavailable, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
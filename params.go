@@ -0,0 +1,122 @@
+package gofast
+
+import (
+	"github.com/yookoala/gofast/protocol"
+)
+
+// Param is a FastCGI name-value pair.
+type Param = protocol.Pair
+
+// Params is an ordered list of FastCGI params. Params are sent
+// to the application in the order they are added, and a name
+// may be sent more than once.
+//
+// The zero value is an empty list ready to use.
+type Params struct {
+	pairs []Param
+}
+
+// Get returns the first value of the given name.
+// Returns an empty string if there is no such param.
+func (p *Params) Get(name string) string {
+	value, _ := p.Lookup(name)
+	return value
+}
+
+// Lookup returns the first value of the given name,
+// and whether the param exists.
+func (p *Params) Lookup(name string) (value string, ok bool) {
+	for _, pair := range p.pairs {
+		if pair.Name == name {
+			return pair.Value, true
+		}
+	}
+	return "", false
+}
+
+// Values returns all values of the given name, in order.
+func (p *Params) Values(name string) (values []string) {
+	for _, pair := range p.pairs {
+		if pair.Name == name {
+			values = append(values, pair.Value)
+		}
+	}
+	return
+}
+
+// Set sets the param to the given value. If the name exists,
+// its first occurrence is replaced in place and the others are
+// removed. Otherwise the param is appended.
+func (p *Params) Set(name, value string) {
+	for i, pair := range p.pairs {
+		if pair.Name == name {
+			p.pairs[i].Value = value
+			p.del(name, i+1)
+			return
+		}
+	}
+	p.pairs = append(p.pairs, Param{Name: name, Value: value})
+}
+
+// Add appends the param, keeping any existing value
+// of the same name.
+func (p *Params) Add(name, value string) {
+	p.pairs = append(p.pairs, Param{Name: name, Value: value})
+}
+
+// Del removes all values of the given name.
+func (p *Params) Del(name string) {
+	p.del(name, 0)
+}
+
+// del removes all values of the given name from
+// the position from and after.
+func (p *Params) del(name string, from int) {
+	pairs := p.pairs[:from]
+	for _, pair := range p.pairs[from:] {
+		if pair.Name != name {
+			pairs = append(pairs, pair)
+		}
+	}
+	p.pairs = pairs
+}
+
+// Len returns the number of params, counting
+// every value of a multi-valued name.
+func (p *Params) Len() int {
+	return len(p.pairs)
+}
+
+// Pairs returns a copy of all the params in order.
+func (p *Params) Pairs() []Param {
+	pairs := make([]Param, len(p.pairs))
+	copy(pairs, p.pairs)
+	return pairs
+}
+
+// Map returns a map view of the params. For a multi-valued
+// name, the first value is used, as in Get. Changes to the
+// map do not affect the params.
+func (p *Params) Map() map[string]string {
+	m := make(map[string]string, len(p.pairs))
+	for _, pair := range p.pairs {
+		if _, ok := m[pair.Name]; !ok {
+			m[pair.Name] = pair.Value
+		}
+	}
+	return m
+}
+
+// check returns *protocol.PairTooLongError if any name
+// or value is too long to be encoded.
+func (p *Params) check() error {
+	for _, pair := range p.pairs {
+		if len(pair.Name) > protocol.MaxPairLength {
+			return &protocol.PairTooLongError{Name: pair.Name, Length: len(pair.Name)}
+		}
+		if len(pair.Value) > protocol.MaxPairLength {
+			return &protocol.PairTooLongError{Name: pair.Name, Length: len(pair.Value)}
+		}
+	}
+	return nil
+}
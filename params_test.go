@@ -0,0 +1,61 @@
+package gofast_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yookoala/gofast"
+)
+
+func TestParams(t *testing.T) {
+	var p gofast.Params
+	p.Set("SERVER_NAME", "example.com")
+	p.Set("REQUEST_METHOD", "GET")
+	p.Add("HTTP_X_FOO", "1")
+	p.Add("HTTP_X_FOO", "2")
+	p.Set("SERVER_PORT", "80")
+
+	if want, have := "1", p.Get("HTTP_X_FOO"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := []string{"1", "2"}, p.Values("HTTP_X_FOO"); !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if _, ok := p.Lookup("HTTPS"); ok {
+		t.Errorf("unexpected param HTTPS")
+	}
+	if want, have := 5, p.Len(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// set replaces the first value in place
+	// and removes the others
+	p.Set("HTTP_X_FOO", "3")
+	p.Set("REQUEST_METHOD", "POST")
+	if want, have := []gofast.Param{
+		{Name: "SERVER_NAME", Value: "example.com"},
+		{Name: "REQUEST_METHOD", Value: "POST"},
+		{Name: "HTTP_X_FOO", Value: "3"},
+		{Name: "SERVER_PORT", Value: "80"},
+	}, p.Pairs(); !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	p.Add("SERVER_NAME", "example.org")
+	p.Del("REQUEST_METHOD")
+	if want, have := map[string]string{
+		"SERVER_NAME": "example.com",
+		"HTTP_X_FOO":  "3",
+		"SERVER_PORT": "80",
+	}, p.Map(); !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := []gofast.Param{
+		{Name: "SERVER_NAME", Value: "example.com"},
+		{Name: "HTTP_X_FOO", Value: "3"},
+		{Name: "SERVER_PORT", Value: "80"},
+		{Name: "SERVER_NAME", Value: "example.org"},
+	}, p.Pairs(); !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
@@ -1,75 +1,670 @@
 package gofast
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"time"
 )
 
+// ErrPoolClosed is returned by ClientPool when the pool is closed.
+var ErrPoolClosed = errors.New("gofast: client pool closed")
+
+// Default values of PoolConfig
+const (
+	DefaultMaxIdle        = 2
+	DefaultDialBackoff    = 100 * time.Millisecond
+	DefaultMaxDialBackoff = 10 * time.Second
+)
+
+// PoolConfig configures a ClientPool.
+type PoolConfig struct {
+	// MaxIdle is the maximum number of idle clients kept in the
+	// pool. If zero, DefaultMaxIdle is used. If negative, no idle
+	// client is kept.
+	MaxIdle int
+
+	// MaxOpen is the maximum number of clients open at the same
+	// time, both idle and in use. If reached, creating a client
+	// waits until one is returned. Zero means no limit.
+	MaxOpen int
+
+	// IdleTimeout is the maximum time a client may be idle in the
+	// pool before it is closed. Zero means no limit.
+	IdleTimeout time.Duration
+
+	// MaxLifetime is the maximum time a client may be reused since
+	// it is created. Zero means no limit.
+	MaxLifetime time.Duration
+
+	// PingIdle is the idle time after which a client is checked
+	// with a FCGI_GET_VALUES query before reuse, in case the
+	// application closed the connection on its side. Zero means
+	// no check. Broken connections noticed without a query are
+	// never reused.
+	PingIdle time.Duration
+
+	// DialBackoff is the time to fail fast after the ClientFactory
+	// failed, instead of calling it again. It doubles on every
+	// consecutive failure, up to MaxDialBackoff. If zero,
+	// DefaultDialBackoff and DefaultMaxDialBackoff are used.
+	// If negative, there is no backoff.
+	DialBackoff    time.Duration
+	MaxDialBackoff time.Duration
+}
+
+// maxIdle returns the effective MaxIdle
+func (config PoolConfig) maxIdle() int {
+	if config.MaxIdle == 0 {
+		return DefaultMaxIdle
+	}
+	if config.MaxIdle < 0 {
+		return 0
+	}
+	return config.MaxIdle
+}
+
+// cleanInterval returns the interval to check for idle
+// clients to close, or zero if there is no need to.
+func (config PoolConfig) cleanInterval() (d time.Duration) {
+	for _, timeout := range []time.Duration{config.IdleTimeout, config.MaxLifetime} {
+		if timeout > 0 && (d == 0 || timeout < d) {
+			d = timeout
+		}
+	}
+	if d /= 2; d > 0 && d < minCleanInterval {
+		d = minCleanInterval
+	}
+	return
+}
+
+// minCleanInterval is the minimum interval to check for
+// idle clients to close.
+const minCleanInterval = 100 * time.Millisecond
+
 // PoolClient wraps a client and alter the Close
 // method for pool return / destroy.
 type PoolClient struct {
 	Client
-	Err          error
-	returnClient chan<- *PoolClient
-	expires      time.Time
+
+	// Err is always nil. Errors of creating the client are
+	// returned by CreateClient.
+	//
+	// Deprecated: check the error of CreateClient instead.
+	Err error
+
+	pool    *ClientPool
+	expires time.Time
+
+	// the time the client is returned to the pool, and if the
+	// client has been returned before, guarded by the pool mutex
+	idleSince time.Time
+	returned  bool
+	reused    bool
 }
 
 // Expired check if the client expired
 func (pc *PoolClient) Expired() bool {
-	return time.Now().After(pc.expires)
+	return !pc.expires.IsZero() && time.Now().After(pc.expires)
 }
 
-// Close close the inner client only
-// if it is expired. Otherwise it will
-// return itself to the pool.
-func (pc *PoolClient) Close() error {
-	if pc.Expired() {
-		return pc.Client.Close()
+// usable checks if the inner client can be reused.
+// Clients that cannot tell are assumed to be usable.
+func (pc *PoolClient) usable() bool {
+	if c, ok := pc.Client.(interface {
+		usable() bool
+	}); ok {
+		return c.usable()
+	}
+	return true
+}
+
+// ping checks if the application still answers. Clients that
+// cannot tell are assumed to be alive.
+func (pc *PoolClient) ping(ctx context.Context) error {
+	if c, ok := pc.Client.(interface {
+		ping(ctx context.Context) error
+	}); ok {
+		ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+		defer cancel()
+		return c.ping(ctx)
 	}
-	go func() {
-		// block wait until the client
-		// is returned.
-		pc.returnClient <- pc
-	}()
 	return nil
 }
 
+// getValues implements valuesGetter
+func (pc *PoolClient) getValues(ctx context.Context) (Values, error) {
+	return clientValues(ctx, pc.Client)
+}
+
+// pingTimeout is the maximum time to wait for the
+// reply of a ping.
+const pingTimeout = time.Second
+
+// Do implements Client.Do
+func (pc *PoolClient) Do(req *Request) (resp *ResponsePipe, err error) {
+	return pc.DoContext(req.Context(), req)
+}
+
+// DoContext implements Client.DoContext. If the client is reused
+// from the pool, and its connection is found broken before the
+// request is sent, the request is retried once on a new client.
+func (pc *PoolClient) DoContext(ctx context.Context, req *Request) (resp *ResponsePipe, err error) {
+	resp, err = pc.Client.DoContext(ctx, req)
+	if err == nil || !pc.reused || ctx.Err() != nil || pc.usable() {
+		return
+	}
+	if pc.pool.redial(ctx, pc) != nil {
+		return
+	}
+	return pc.Client.DoContext(ctx, req)
+}
+
+// Close returns the client to the pool. The inner client
+// is closed instead if it is expired, not usable (e.g. the
+// connection is broken or discarded), or if the pool is
+// closed or has enough idle clients.
+//
+// Close should only be called once. Closing a client that
+// is returned does nothing.
+func (pc *PoolClient) Close() error {
+	return pc.pool.put(pc)
+}
+
 // NewClientPool creates a *ClientPool
 // from the given ClientFactory and pool
 // it to scale with expiration.
+//
+// It is a shortcut of NewPool with scale as MaxIdle and
+// expires as MaxLifetime. If scale is zero, no idle client
+// is kept. If expires is not positive, clients expire as
+// soon as they are created, so they are never reused.
 func NewClientPool(
 	clientFactory ClientFactory,
 	scale uint,
 	expires time.Duration,
 ) *ClientPool {
-	pool := make(chan *PoolClient, scale)
-	go func() {
-		for {
-			c, err := clientFactory()
-			pc := &PoolClient{
-				Client:       c,
-				Err:          err,
-				returnClient: pool,
-				expires:      time.Now().Add(expires),
-			}
-			pool <- pc
+	config := PoolConfig{
+		MaxIdle:     int(scale),
+		MaxLifetime: expires,
+	}
+	if scale == 0 || expires <= 0 {
+		config.MaxIdle, config.MaxLifetime = -1, 0
+	}
+	return NewPool(clientFactory.ContextClientFactory(), config)
+}
+
+// NewPool creates a *ClientPool of clients from the given
+// ContextClientFactory. Clients are created on demand, and
+// kept for reuse after they are closed, as configured.
+func NewPool(clientFactory ContextClientFactory, config PoolConfig) *ClientPool {
+	if config.DialBackoff == 0 {
+		config.DialBackoff = DefaultDialBackoff
+		if config.MaxDialBackoff == 0 {
+			config.MaxDialBackoff = DefaultMaxDialBackoff
 		}
-	}()
-	return &ClientPool{
-		createClient: pool,
 	}
+	if config.MaxDialBackoff < config.DialBackoff {
+		config.MaxDialBackoff = config.DialBackoff
+	}
+	p := &ClientPool{
+		clientFactory: clientFactory,
+		config:        config,
+	}
+	if interval := config.cleanInterval(); interval > 0 {
+		p.stopCleaner = make(chan struct{})
+		p.cleanerDone = make(chan struct{})
+		go p.cleaner(interval)
+	}
+	return p
 }
 
 // ClientPool pools client created from
 // a given ClientFactory.
 type ClientPool struct {
-	createClient <-chan *PoolClient
+	clientFactory ContextClientFactory
+	config        PoolConfig
+
+	// stops the cleaner goroutine, if any
+	stopCleaner chan struct{}
+	cleanerDone chan struct{}
+
+	// mutex guards all the fields below
+	mutex sync.Mutex
+
+	// idle clients, the most recently returned last
+	idle []*PoolClient
+
+	// number of clients open, including the ones being created
+	numOpen int
+
+	// goroutines waiting for a client, in order. A waiter gets
+	// either a returned client, or nil if it may create one.
+	waiters []chan *PoolClient
+
+	// the last error of the ClientFactory, and until when
+	// to fail fast with it
+	dialErr      error
+	backoff      time.Duration
+	backoffUntil time.Time
+
+	// counters reported by Stats
+	waitCount         int64
+	waitDuration      time.Duration
+	dialCount         int64
+	dialErrorCount    int64
+	maxIdleClosed     int64
+	idleTimeoutClosed int64
+	lifetimeClosed    int64
+	errorClosed       int64
+
+	closed bool
+}
+
+// PoolStats is a snapshot of the statistics of a ClientPool.
+type PoolStats struct {
+	MaxOpen int // maximum number of open clients, or 0 if unlimited
+
+	// Clients
+	Open  int // number of open clients, idle or in use
+	InUse int // number of clients in use, or being created
+	Idle  int // number of idle clients
+
+	// Creating clients
+	DialCount      int64 // number of calls to the ClientFactory
+	DialErrorCount int64 // number of errors from the ClientFactory
+
+	// Waiting for clients
+	WaitCount    int64         // total number of clients waited for
+	WaitDuration time.Duration // total time waited for clients
+
+	// Closed clients
+	MaxIdleClosed     int64 // closed due to MaxIdle
+	IdleTimeoutClosed int64 // closed due to IdleTimeout
+	LifetimeClosed    int64 // closed due to MaxLifetime
+	ErrorClosed       int64 // closed due to a broken or unusable connection
+}
+
+// Stats returns the statistics of the pool.
+func (p *ClientPool) Stats() PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return PoolStats{
+		MaxOpen: p.config.MaxOpen,
+
+		Open:  p.numOpen,
+		InUse: p.numOpen - len(p.idle),
+		Idle:  len(p.idle),
+
+		DialCount:      p.dialCount,
+		DialErrorCount: p.dialErrorCount,
+
+		WaitCount:    p.waitCount,
+		WaitDuration: p.waitDuration,
+
+		MaxIdleClosed:     p.maxIdleClosed,
+		IdleTimeoutClosed: p.idleTimeoutClosed,
+		LifetimeClosed:    p.lifetimeClosed,
+		ErrorClosed:       p.errorClosed,
+	}
 }
 
 // CreateClient implements ClientFactory
 func (p *ClientPool) CreateClient() (c Client, err error) {
-	pc := <-p.createClient
-	if c, err = pc, pc.Err; err != nil {
+	return p.CreateClientContext(context.Background())
+}
+
+// CreateClientContext implements ContextClientFactory. It reuses
+// an idle client, or creates a new one if MaxOpen is not reached.
+// Otherwise it waits for a client to be returned until the context
+// is done.
+func (p *ClientPool) CreateClientContext(ctx context.Context) (c Client, err error) {
+	pc, err := p.get(ctx)
+	if err != nil {
 		return nil, err
 	}
+	return pc, nil
+}
+
+// Close closes the pool and all the idle clients. Clients in use
+// are closed when they are returned. Goroutines waiting for a client
+// get ErrPoolClosed.
+func (p *ClientPool) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return ErrPoolClosed
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.numOpen -= len(idle)
+	for _, wait := range p.waiters {
+		wait <- nil
+	}
+	p.waiters = nil
+	p.mutex.Unlock()
+
+	if p.stopCleaner != nil {
+		close(p.stopCleaner)
+		<-p.cleanerDone
+	}
+
+	var err error
+	for _, pc := range idle {
+		if cerr := pc.Client.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// get takes an idle client or creates a new one.
+func (p *ClientPool) get(ctx context.Context) (pc *PoolClient, err error) {
+	var stale []*PoolClient
+	defer func() {
+		for _, pc := range stale {
+			pc.Client.Close()
+		}
+	}()
+
+	p.mutex.Lock()
+	for {
+		if p.closed {
+			p.mutex.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if err = ctx.Err(); err != nil {
+			p.mutex.Unlock()
+			return nil, ctxError(ctx)
+		}
+
+		// reuse the most recently returned client
+		for len(p.idle) > 0 {
+			pc = p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			if p.closeStale(pc, time.Now(), &stale) {
+				continue
+			}
+			if p.config.PingIdle <= 0 || time.Since(pc.idleSince) < p.config.PingIdle {
+				pc.returned = false
+				p.mutex.Unlock()
+				return
+			}
+
+			// check if the application closed the connection
+			p.mutex.Unlock()
+			perr := pc.ping(ctx)
+			p.mutex.Lock()
+			if perr == nil {
+				pc.returned = false
+				p.mutex.Unlock()
+				return
+			}
+			stale = append(stale, pc)
+			p.numOpen--
+			p.errorClosed++
+			p.notify()
+			if p.closed || ctx.Err() != nil {
+				break
+			}
+		}
+		if p.closed || ctx.Err() != nil {
+			continue
+		}
+		pc = nil
+
+		if p.config.MaxOpen <= 0 || p.numOpen < p.config.MaxOpen {
+			break
+		}
+
+		// wait for a client to be returned, or closed
+		wait := make(chan *PoolClient, 1)
+		p.waiters = append(p.waiters, wait)
+		p.waitCount++
+		p.mutex.Unlock()
+
+		waitStart := time.Now()
+		select {
+		case pc = <-wait:
+			p.mutex.Lock()
+			p.waitDuration += time.Since(waitStart)
+			p.mutex.Unlock()
+		case <-ctx.Done():
+			p.mutex.Lock()
+			p.waitDuration += time.Since(waitStart)
+			if !p.removeWaiter(wait) {
+				// the waiter is served in the meantime,
+				// pass it on
+				if pc = <-wait; pc != nil {
+					p.putLocked(pc, &stale)
+				} else {
+					p.notify()
+				}
+			}
+			p.mutex.Unlock()
+			return nil, ctxError(ctx)
+		}
+		if pc != nil {
+			return
+		}
+		p.mutex.Lock()
+	}
+
+	// fail fast if the factory failed recently
+	if p.dialErr != nil && time.Now().Before(p.backoffUntil) {
+		err = p.dialErr
+		p.mutex.Unlock()
+		return
+	}
+	p.numOpen++
+	p.dialCount++
+	p.mutex.Unlock()
+
+	c, err := p.clientFactory(ctx)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err != nil {
+		p.numOpen--
+		p.notify()
+		if ctx.Err() == nil {
+			p.dialErrorCount++
+			p.failDial(err)
+		}
+		return nil, err
+	}
+	p.dialErr, p.backoff = nil, 0
+	if p.closed {
+		p.numOpen--
+		stale = append(stale, &PoolClient{Client: c})
+		return nil, ErrPoolClosed
+	}
+	pc = &PoolClient{
+		Client: c,
+		pool:   p,
+	}
+	if p.config.MaxLifetime > 0 {
+		pc.expires = time.Now().Add(p.config.MaxLifetime)
+	}
 	return
 }
+
+// redial replaces the broken client of pc with a new one. The broken
+// client is only closed if a new one is created.
+func (p *ClientPool) redial(ctx context.Context, pc *PoolClient) error {
+	p.mutex.Lock()
+	p.dialCount++
+	p.mutex.Unlock()
+
+	c, err := p.clientFactory(ctx)
+
+	p.mutex.Lock()
+	if err != nil {
+		if ctx.Err() == nil {
+			p.dialErrorCount++
+			p.failDial(err)
+		}
+		p.mutex.Unlock()
+		return err
+	}
+	p.dialErr, p.backoff = nil, 0
+	p.errorClosed++
+	broken := pc.Client
+	pc.Client, pc.reused = c, false
+	pc.expires = time.Time{}
+	if p.config.MaxLifetime > 0 {
+		pc.expires = time.Now().Add(p.config.MaxLifetime)
+	}
+	p.mutex.Unlock()
+
+	broken.Close()
+	return nil
+}
+
+// failDial records the error of the ClientFactory and extends
+// the backoff. Must be called with p.mutex locked.
+func (p *ClientPool) failDial(err error) {
+	p.dialErr = err
+	if p.config.DialBackoff < 0 {
+		return
+	}
+	if p.backoff == 0 {
+		p.backoff = p.config.DialBackoff
+	} else if p.backoff *= 2; p.backoff > p.config.MaxDialBackoff {
+		p.backoff = p.config.MaxDialBackoff
+	}
+	p.backoffUntil = time.Now().Add(p.backoff)
+}
+
+// closeStale checks if an idle client cannot be reused at the given
+// time. If so, it is appended to stale to be closed, and true is
+// returned. Must be called with p.mutex locked.
+func (p *ClientPool) closeStale(pc *PoolClient, now time.Time, stale *[]*PoolClient) bool {
+	switch {
+	case !pc.expires.IsZero() && now.After(pc.expires):
+		p.lifetimeClosed++
+	case p.config.IdleTimeout > 0 && now.Sub(pc.idleSince) > p.config.IdleTimeout:
+		p.idleTimeoutClosed++
+	case !pc.usable():
+		p.errorClosed++
+	default:
+		return false
+	}
+	*stale = append(*stale, pc)
+	p.numOpen--
+	p.notify()
+	return true
+}
+
+// removeWaiter removes the given waiter. Returns false if it is
+// not found (i.e. it is served). Must be called with p.mutex locked.
+func (p *ClientPool) removeWaiter(wait chan *PoolClient) bool {
+	for i, w := range p.waiters {
+		if w == wait {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// notify tells the first waiter, if any, that it may create
+// a client. Must be called with p.mutex locked.
+func (p *ClientPool) notify() {
+	if len(p.waiters) > 0 {
+		p.waiters[0] <- nil
+		p.waiters = p.waiters[1:]
+	}
+}
+
+// put returns a client to the pool, or closes it.
+func (p *ClientPool) put(pc *PoolClient) error {
+	var stale []*PoolClient
+	p.mutex.Lock()
+	if pc.returned {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.putLocked(pc, &stale)
+	p.mutex.Unlock()
+
+	var err error
+	for _, pc := range stale {
+		err = pc.Client.Close()
+	}
+	return err
+}
+
+// putLocked returns a client to the pool. Clients to be closed
+// are appended to stale. Must be called with p.mutex locked.
+func (p *ClientPool) putLocked(pc *PoolClient, stale *[]*PoolClient) {
+	pc.returned, pc.reused = true, true
+	if p.closed {
+		*stale = append(*stale, pc)
+		p.numOpen--
+		return
+	}
+	if p.closeStale(pc, time.Now(), stale) {
+		return
+	}
+
+	// hand over to a waiter directly
+	if len(p.waiters) > 0 {
+		pc.returned = false
+		p.waiters[0] <- pc
+		p.waiters = p.waiters[1:]
+		return
+	}
+
+	if len(p.idle) >= p.config.maxIdle() {
+		*stale = append(*stale, pc)
+		p.numOpen--
+		p.maxIdleClosed++
+		return
+	}
+	pc.idleSince = time.Now()
+	p.idle = append(p.idle, pc)
+
+	// watch the idle connection, so that it is known to be
+	// broken if the application closes it
+	if c, ok := pc.Client.(interface {
+		startReadLoop()
+	}); ok {
+		c.startReadLoop()
+	}
+}
+
+// cleaner closes idle clients that are expired or idle for
+// too long, until the pool is closed.
+func (p *ClientPool) cleaner(interval time.Duration) {
+	defer close(p.cleanerDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCleaner:
+			return
+		case now := <-ticker.C:
+			p.clean(now)
+		}
+	}
+}
+
+// clean closes idle clients that cannot be reused at the given time.
+func (p *ClientPool) clean(now time.Time) {
+	var stale []*PoolClient
+	p.mutex.Lock()
+	idle := p.idle[:0]
+	for _, pc := range p.idle {
+		if !p.closeStale(pc, now, &stale) {
+			idle = append(idle, pc)
+		}
+	}
+	p.idle = idle
+	p.mutex.Unlock()
+
+	for _, pc := range stale {
+		pc.Client.Close()
+	}
+}
@@ -1,8 +1,15 @@
 package gofast
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -10,11 +17,27 @@ import (
 
 // mockConn is a net.Conn implementation only
 // indicates if its Close method been called or not.
-// If it is true, means the Close method has been called.
-type mockConn bool
+// Read blocks until it is closed.
+type mockConn struct {
+	mutex  sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func newMockConn() *mockConn {
+	return &mockConn{done: make(chan struct{})}
+}
+
+// Closed reports if the Close method has been called.
+func (mc *mockConn) Closed() bool {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	return mc.closed
+}
 
 func (mc *mockConn) Read(b []byte) (n int, err error) {
-	return 0, nil
+	<-mc.done
+	return 0, io.EOF
 }
 
 func (mc *mockConn) Write(b []byte) (n int, err error) {
@@ -22,7 +45,12 @@ func (mc *mockConn) Write(b []byte) (n int, err error) {
 }
 
 func (mc *mockConn) Close() error {
-	*mc = true
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	if !mc.closed {
+		mc.closed = true
+		close(mc.done)
+	}
 	return nil
 }
 
@@ -63,33 +91,50 @@ func TestPoolClient_Expired(t *testing.T) {
 }
 
 func TestPoolClient_Close(t *testing.T) {
+	newPool := func() (p *ClientPool, c *client) {
+		c = &client{}
+		p = NewPool(func(ctx context.Context) (Client, error) {
+			return c, nil
+		}, PoolConfig{})
+		return
+	}
+
 	// client that expired should be closed for real
 	// while the pool gets nothing
-	ch := make(chan *PoolClient)
-	defer close(ch)
-	pc := &PoolClient{
-		Client:       &client{},
-		expires:      time.Now().Add(-time.Millisecond),
-		returnClient: ch,
-	}
+	p, _ := newPool()
+	pc, _ := p.get(context.Background())
+	pc.expires = time.Now().Add(-time.Millisecond)
 	pc.Close()
-	select {
-	case pcClosed := <-ch:
-		t.Errorf("unexpected client from the pool: %#v", pcClosed)
-	case <-time.After(10 * time.Millisecond):
-		t.Logf("no getting anything from pool, as expected.")
+	if want, have := 0, len(p.idle); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := 0, p.numOpen; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
 	}
 
 	// client has not expired should got returned
-	pc.expires = time.Now().Add(time.Millisecond)
+	p, _ = newPool()
+	pc, _ = p.get(context.Background())
+	pc.expires = time.Now().Add(time.Minute)
 	pc.Close()
-	select {
-	case pcClosed := <-ch:
-		if want, have := pc, pcClosed; want != have {
-			t.Errorf("expected %#v, got %#v", want, have)
-		}
-	case <-time.After(10 * time.Millisecond):
-		t.Errorf("expected to get returned client, got nothing but blocked")
+	if want, have := []*PoolClient{pc}, p.idle; !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// closing again does nothing
+	pc.Close()
+	if want, have := 1, len(p.idle); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// client that is closing (e.g. sent a request without
+	// FCGI_KEEP_CONN) should not be returned
+	p, c := newPool()
+	pc, _ = p.get(context.Background())
+	c.closing = true
+	pc.Close()
+	if want, have := 0, len(p.idle); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
 	}
 }
 
@@ -134,17 +179,61 @@ func TestClientPool_CreateClient_withErr(t *testing.T) {
 }
 
 func TestClientPool_CreateClient_Return_0(t *testing.T) {
+	tests := []struct {
+		desc    string
+		scale   uint
+		expires time.Duration
+	}{
+		{"no idle client", 0, 1000 * time.Millisecond},
+		{"expired on creation", 40, 0},
+	}
+
+	for _, test := range tests {
+		var counter uint64
+		cp := NewClientPool(
+			SimpleClientFactory(func() (net.Conn, error) {
+				atomic.AddUint64(&counter, 1)
+				return newMockConn(), nil
+			}),
+			test.scale, test.expires,
+		)
+
+		// the returned client is closed, not reused
+		c1, err := cp.CreateClient()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err.Error())
+		}
+		conn := mockConnOf(c1)
+		c1.Close()
+		if !conn.Closed() {
+			t.Errorf("%s: expected the returned client to be closed", test.desc)
+		}
+		c2, err := cp.CreateClient()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err.Error())
+		}
+		if c1 == c2 {
+			t.Errorf("%s: expected the returned client not to be reused", test.desc)
+		}
+		c2.Close()
+		if want, have := uint64(2), atomic.LoadUint64(&counter); want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.desc, want, have)
+		}
+		cp.Close()
+	}
+}
+
+func TestClientPool_CreateClient_Return_40(t *testing.T) {
 
 	var counter uint64
 
 	// buffered client with error
 	cp := NewClientPool(
 		SimpleClientFactory(func() (net.Conn, error) {
-			conn := mockConn(false)
 			atomic.AddUint64(&counter, 1)
-			return &conn, nil
+			return newMockConn(), nil
 		}),
-		0, 1000*time.Millisecond,
+		40, 1000*time.Millisecond,
 	)
 
 	// create first client
@@ -185,54 +274,274 @@ func TestClientPool_CreateClient_Return_0(t *testing.T) {
 	}
 }
 
-func TestClientPool_CreateClient_Return_40(t *testing.T) {
+// newMockPool creates a pool of clients on mockConn. The
+// number of clients created is counted in counter.
+func newMockPool(counter *uint64, config PoolConfig) *ClientPool {
+	return NewPool(SimpleClientFactory(func() (net.Conn, error) {
+		atomic.AddUint64(counter, 1)
+		return newMockConn(), nil
+	}).ContextClientFactory(), config)
+}
 
-	var counter uint64
+// mockConnOf returns the mockConn of a client from newMockPool.
+func mockConnOf(c Client) *mockConn {
+	rwc := c.(*PoolClient).Client.(*client).conn.rwc
+	return rwc.(*deadlineConn).ReadWriteCloser.(*mockConn)
+}
 
-	// buffered client with error
-	cp := NewClientPool(
-		SimpleClientFactory(func() (net.Conn, error) {
-			conn := mockConn(false)
-			atomic.AddUint64(&counter, 1)
-			return &conn, nil
-		}),
-		40, 1000*time.Millisecond,
-	)
+func TestClientPool_MaxOpen(t *testing.T) {
+	var counter uint64
+	cp := newMockPool(&counter, PoolConfig{MaxOpen: 1})
+	defer cp.Close()
 
-	// create first client
 	c1, err := cp.CreateClient()
-	if c1 == nil {
-		t.Error("expected client, got nil")
-	}
 	if err != nil {
-		t.Errorf("unexpected error: %s", err.Error())
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// wait until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := cp.CreateClientContext(ctx); err != ErrTimeout {
+		t.Errorf("expected %#v, got %#v", ErrTimeout, err)
 	}
-	c1.Close()
 
+	// the returned client is handed over to the waiting one
 	reused := make(chan Client)
 	go func() {
-		// loop until getting the supposedly returned client
-		for {
-			c, err := cp.CreateClient()
-			if c == nil {
-				t.Error("expected client, got nil")
-			}
-			if err != nil {
-				t.Errorf("unexpected error: %s", err.Error())
-			}
-			if c1 == c {
-				reused <- c
-				break
-			}
+		c, err := cp.CreateClient()
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
 		}
+		reused <- c
 	}()
-
+	time.Sleep(10 * time.Millisecond)
+	c1.Close()
 	select {
-	case <-reused:
-		total := atomic.LoadUint64(&counter)
-		t.Logf("returned client got reused with %d concurrent connections",
-			total)
-	case <-time.After(10 * time.Millisecond):
+	case c := <-reused:
+		if want, have := c1, c; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		c.Close()
+	case <-time.After(time.Second):
 		t.Errorf("client is not reused")
 	}
+	if want, have := uint64(1), atomic.LoadUint64(&counter); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestClientPool_IdleTimeout(t *testing.T) {
+	var counter uint64
+	cp := newMockPool(&counter, PoolConfig{IdleTimeout: 10 * time.Millisecond})
+	defer cp.Close()
+
+	c1, _ := cp.CreateClient()
+	c1.Close()
+
+	// closed by the cleaner
+	time.Sleep(200 * time.Millisecond)
+	cp.mutex.Lock()
+	if want, have := 0, cp.numOpen; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	cp.mutex.Unlock()
+	c2, _ := cp.CreateClient()
+	if c1 == c2 {
+		t.Errorf("expected a new client, got the idle one")
+	}
+	c2.Close()
+}
+
+func TestClientPool_dialBackoff(t *testing.T) {
+	var counter uint64
+	cp := NewPool(func(ctx context.Context) (Client, error) {
+		atomic.AddUint64(&counter, 1)
+		return nil, fmt.Errorf("dummy error")
+	}, PoolConfig{DialBackoff: 50 * time.Millisecond})
+	defer cp.Close()
+
+	// fail fast with the last error during backoff
+	for i := 0; i < 3; i++ {
+		if _, err := cp.CreateClient(); err == nil || err.Error() != "dummy error" {
+			t.Errorf("expected dummy error, got %#v", err)
+		}
+	}
+	if want, have := uint64(1), atomic.LoadUint64(&counter); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// try again after the backoff
+	time.Sleep(60 * time.Millisecond)
+	cp.CreateClient()
+	if want, have := uint64(2), atomic.LoadUint64(&counter); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestClientPool_Close(t *testing.T) {
+	var counter uint64
+	cp := newMockPool(&counter, PoolConfig{MaxOpen: 2, IdleTimeout: time.Minute})
+
+	c1, _ := cp.CreateClient()
+	c2, _ := cp.CreateClient()
+	conn2 := mockConnOf(c2)
+	c1.Close()
+
+	// waiting goroutine gets ErrPoolClosed
+	errs := make(chan error)
+	go func() {
+		cp.CreateClient() // takes c1
+		_, err := cp.CreateClient()
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := cp.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if want, have := ErrPoolClosed, <-errs; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// client in use is closed when returned
+	if want, have := false, conn2.Closed(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	c2.Close()
+	if want, have := true, conn2.Closed(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if _, err := cp.CreateClient(); err != ErrPoolClosed {
+		t.Errorf("expected %#v, got %#v", ErrPoolClosed, err)
+	}
+}
+
+func TestClientPool_Stats(t *testing.T) {
+	var counter uint64
+	cp := newMockPool(&counter, PoolConfig{MaxOpen: 2, MaxIdle: 1})
+	defer cp.Close()
+
+	c1, _ := cp.CreateClient()
+	c2, _ := cp.CreateClient()
+	if want, have := (PoolStats{
+		MaxOpen:   2,
+		Open:      2,
+		InUse:     2,
+		DialCount: 2,
+	}), cp.Stats(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// waiting for a client
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	cp.CreateClientContext(ctx)
+	stats := cp.Stats()
+	if want, have := int64(1), stats.WaitCount; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if stats.WaitDuration < 10*time.Millisecond {
+		t.Errorf("expected wait duration of at least 10ms, got %s", stats.WaitDuration)
+	}
+
+	// returning clients over MaxIdle, or broken
+	c1.Close()
+	c2.Close()
+	c3, _ := cp.CreateClient()
+	c3.(*PoolClient).Client.(*client).closing = true
+	c3.Close()
+	stats = cp.Stats()
+	if want, have := 0, stats.Open; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := int64(1), stats.MaxIdleClosed; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := int64(1), stats.ErrorClosed; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+// brokenConn is a net.Conn that fails writing once broken,
+// like a connection closed by the application but not yet
+// noticed by reading.
+type brokenConn struct {
+	net.Conn
+	broken int32
+}
+
+func (bc *brokenConn) Write(b []byte) (n int, err error) {
+	if atomic.LoadInt32(&bc.broken) == 1 {
+		return 0, fmt.Errorf("broken pipe")
+	}
+	return bc.Conn.Write(b)
+}
+
+func TestClientPool_staleConn(t *testing.T) {
+	srv := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "hello")
+		}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	doRequest := func(c Client) string {
+		req := NewRequest(nil)
+		req.Params.Set("REQUEST_METHOD", "GET")
+		req.Params.Set("SERVER_PROTOCOL", "HTTP/1.1")
+		req.Params.Set("REQUEST_URI", "/")
+		resp, err := c.Do(req)
+		if err != nil {
+			return err.Error()
+		}
+		w := httptest.NewRecorder()
+		resp.WriteTo(w, new(bytes.Buffer))
+		return w.Body.String()
+	}
+
+	for _, pingIdle := range []time.Duration{0, time.Nanosecond} {
+		var conns []*brokenConn
+		cp := NewPool(func(ctx context.Context) (Client, error) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			bc := &brokenConn{Conn: conn}
+			conns = append(conns, bc)
+			return newClient(bc), nil
+		}, PoolConfig{PingIdle: pingIdle})
+
+		c1, _ := cp.CreateClient()
+		if want, have := "hello", doRequest(c1); want != have {
+			t.Errorf("pingIdle=%s: expected %#v, got %#v", pingIdle, want, have)
+		}
+		c1.Close()
+
+		// the idle connection is broken, and found by the ping
+		// on borrow, or by the request which is then retried
+		atomic.StoreInt32(&conns[0].broken, 1)
+		c2, _ := cp.CreateClient()
+		if want, have := "hello", doRequest(c2); want != have {
+			t.Errorf("pingIdle=%s: expected %#v, got %#v", pingIdle, want, have)
+		}
+		c2.Close()
+
+		stats := cp.Stats()
+		if want, have := int64(2), stats.DialCount; want != have {
+			t.Errorf("pingIdle=%s: expected %#v, got %#v", pingIdle, want, have)
+		}
+		if want, have := int64(1), stats.ErrorClosed; want != have {
+			t.Errorf("pingIdle=%s: expected %#v, got %#v", pingIdle, want, have)
+		}
+		if want, have := 1, stats.Idle; want != have {
+			t.Errorf("pingIdle=%s: expected %#v, got %#v", pingIdle, want, have)
+		}
+		cp.Close()
+	}
 }
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"encoding/binary"
+)
+
+// BeginRequest is the body of FCGI_BEGIN_REQUEST
+type BeginRequest struct {
+	Role  Role
+	Flags uint8
+}
+
+// KeepConn reports if FlagKeepConn is set
+func (br BeginRequest) KeepConn() bool {
+	return br.Flags&FlagKeepConn != 0
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (br BeginRequest) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b, uint16(br.Role))
+	b[2] = br.Flags
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (br *BeginRequest) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return &TruncatedError{Type: TypeBeginRequest, Want: 8, Have: len(data)}
+	}
+	br.Role = Role(binary.BigEndian.Uint16(data))
+	br.Flags = data[2]
+	return nil
+}
+
+// EndRequest is the body of FCGI_END_REQUEST
+type EndRequest struct {
+	AppStatus      uint32
+	ProtocolStatus ProtocolStatus
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (er EndRequest) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, er.AppStatus)
+	b[4] = uint8(er.ProtocolStatus)
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (er *EndRequest) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return &TruncatedError{Type: TypeEndRequest, Want: 8, Have: len(data)}
+	}
+	er.AppStatus = binary.BigEndian.Uint32(data)
+	er.ProtocolStatus = ProtocolStatus(data[4])
+	return nil
+}
+
+// UnknownType is the body of FCGI_UNKNOWN_TYPE
+type UnknownType struct {
+	Type RecordType
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (ut UnknownType) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 8)
+	b[0] = byte(ut.Type)
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (ut *UnknownType) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return &TruncatedError{Type: TypeUnknownType, Want: 8, Have: len(data)}
+	}
+	ut.Type = RecordType(data[0])
+	return nil
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrContentTooLong is returned when writing a record with
+// content longer than MaxContentLength.
+var ErrContentTooLong = errors.New("fcgi: record content too long")
+
+// VersionError is returned when reading a record of
+// unsupported protocol version.
+type VersionError struct {
+	Version uint8
+}
+
+// Error implements error
+func (err *VersionError) Error() string {
+	return fmt.Sprintf("fcgi: invalid header version %d", err.Version)
+}
+
+// TruncatedError is returned when a record, or a record
+// body, is shorter than it should be.
+type TruncatedError struct {
+	// Type of the record. Name-value pairs are
+	// reported as TypeParams.
+	Type RecordType
+
+	// Want is the expected length, and Have is the
+	// actual length
+	Want, Have int
+}
+
+// Error implements error
+func (err *TruncatedError) Error() string {
+	return fmt.Sprintf("fcgi: truncated %s content: want %d bytes, have %d",
+		err.Type, err.Want, err.Have)
+}
+
+// PairTooLongError is returned when encoding a name-value pair
+// with name or value longer than MaxPairLength.
+type PairTooLongError struct {
+	Name   string
+	Length int
+}
+
+// Error implements error
+func (err *PairTooLongError) Error() string {
+	name := err.Name
+	if len(name) > 32 {
+		name = name[:32] + "..."
+	}
+	return fmt.Sprintf("fcgi: pair %q too long (%d bytes)", name, err.Length)
+}
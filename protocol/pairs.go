@@ -0,0 +1,104 @@
+package protocol
+
+import (
+	"encoding/binary"
+)
+
+// Pair is a name-value pair, as in FCGI_PARAMS,
+// FCGI_GET_VALUES and FCGI_GET_VALUES_RESULT
+type Pair struct {
+	Name  string
+	Value string
+}
+
+// Pairs is the body of FCGI_GET_VALUES, FCGI_GET_VALUES_RESULT
+// or the whole FCGI_PARAMS stream.
+type Pairs []Pair
+
+// MarshalBinary implements encoding.BinaryMarshaler. It returns
+// *PairTooLongError if any name or value is too long.
+func (pairs Pairs) MarshalBinary() ([]byte, error) {
+	n := 0
+	for _, pair := range pairs {
+		if len(pair.Name) > MaxPairLength {
+			return nil, &PairTooLongError{Name: pair.Name, Length: len(pair.Name)}
+		}
+		if len(pair.Value) > MaxPairLength {
+			return nil, &PairTooLongError{Name: pair.Name, Length: len(pair.Value)}
+		}
+		n += 8 + len(pair.Name) + len(pair.Value)
+	}
+	b := make([]byte, 0, n)
+	for _, pair := range pairs {
+		b = appendSize(b, uint32(len(pair.Name)))
+		b = appendSize(b, uint32(len(pair.Value)))
+		b = append(b, pair.Name...)
+		b = append(b, pair.Value...)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. The
+// pairs are appended to the existing ones. If the data is
+// truncated, the complete pairs before are appended and
+// *TruncatedError is returned.
+func (pairs *Pairs) UnmarshalBinary(data []byte) error {
+	for len(data) > 0 {
+		nameLen, n := readSize(data)
+		if n == 0 {
+			return &TruncatedError{Type: TypeParams, Want: 4, Have: len(data)}
+		}
+		data = data[n:]
+		valueLen, n := readSize(data)
+		if n == 0 {
+			return &TruncatedError{Type: TypeParams, Want: 4, Have: len(data)}
+		}
+		data = data[n:]
+		if want := uint64(nameLen) + uint64(valueLen); want > uint64(len(data)) {
+			return &TruncatedError{Type: TypeParams, Want: int(want), Have: len(data)}
+		}
+		*pairs = append(*pairs, Pair{
+			Name:  string(data[:nameLen]),
+			Value: string(data[nameLen : nameLen+valueLen]),
+		})
+		data = data[nameLen+valueLen:]
+	}
+	return nil
+}
+
+// Map returns the pairs as a map. For repeated names,
+// the first value is used.
+func (pairs Pairs) Map() map[string]string {
+	m := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		if _, ok := m[pair.Name]; !ok {
+			m[pair.Name] = pair.Value
+		}
+	}
+	return m
+}
+
+func appendSize(b []byte, size uint32) []byte {
+	if size > 127 {
+		var s [4]byte
+		binary.BigEndian.PutUint32(s[:], size|1<<31)
+		return append(b, s[:]...)
+	}
+	return append(b, byte(size))
+}
+
+func readSize(s []byte) (uint32, int) {
+	if len(s) == 0 {
+		return 0, 0
+	}
+	size, n := uint32(s[0]), 1
+	if size&(1<<7) != 0 {
+		if len(s) < 4 {
+			return 0, 0
+		}
+		n = 4
+		size = binary.BigEndian.Uint32(s)
+		size &^= 1 << 31
+	}
+	return size, n
+}
@@ -0,0 +1,158 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package protocol implements the record layer of FastCGI, as
+// defined at http://www.mit.edu/~yandros/doc/specs/fcgi-spec.html
+//
+// It reads and writes raw records, and encodes / decodes the
+// record bodies. It knows nothing about requests or connections,
+// so it can be used to build proxies, sniffers or custom
+// servers and clients.
+package protocol
+
+import (
+	"fmt"
+)
+
+// Version is the only FastCGI protocol version (FCGI_VERSION_1)
+const Version = 1
+
+// Lengths specified in the fastcgi spec
+const (
+	// HeaderLength is the length of a record header (FCGI_HEADER_LEN)
+	HeaderLength = 8
+
+	// MaxContentLength is the maximum length of a record content
+	MaxContentLength = 65535
+
+	// MaxPaddingLength is the maximum length of a record padding
+	MaxPaddingLength = 255
+
+	// MaxPairLength is the maximum length of a name or a value
+	// in a name-value pair (31-bit)
+	MaxPairLength = 1<<31 - 1
+)
+
+// NullRequestID is the request ID of management records
+// (FCGI_NULL_REQUEST_ID)
+const NullRequestID = 0
+
+// RecordType is a record type, as defined by
+// http://www.mit.edu/~yandros/doc/specs/fcgi-spec.html#S8
+type RecordType uint8
+
+// Record types specified in the fastcgi spec
+const (
+	TypeBeginRequest    RecordType = 1
+	TypeAbortRequest    RecordType = 2
+	TypeEndRequest      RecordType = 3
+	TypeParams          RecordType = 4
+	TypeStdin           RecordType = 5
+	TypeStdout          RecordType = 6
+	TypeStderr          RecordType = 7
+	TypeData            RecordType = 8
+	TypeGetValues       RecordType = 9
+	TypeGetValuesResult RecordType = 10
+	TypeUnknownType     RecordType = 11
+)
+
+// String implements fmt.Stringer
+func (t RecordType) String() string {
+	switch t {
+	case TypeBeginRequest:
+		return "FCGI_BEGIN_REQUEST"
+	case TypeAbortRequest:
+		return "FCGI_ABORT_REQUEST"
+	case TypeEndRequest:
+		return "FCGI_END_REQUEST"
+	case TypeParams:
+		return "FCGI_PARAMS"
+	case TypeStdin:
+		return "FCGI_STDIN"
+	case TypeStdout:
+		return "FCGI_STDOUT"
+	case TypeStderr:
+		return "FCGI_STDERR"
+	case TypeData:
+		return "FCGI_DATA"
+	case TypeGetValues:
+		return "FCGI_GET_VALUES"
+	case TypeGetValuesResult:
+		return "FCGI_GET_VALUES_RESULT"
+	case TypeUnknownType:
+		fallthrough
+	default:
+		return "FCGI_UNKNOWN_TYPE"
+	}
+}
+
+// GoString implements fmt.GoStringer
+func (t RecordType) GoString() string {
+	return t.String()
+}
+
+// IsManagement reports if the type is one of the management
+// record types known by the spec.
+func (t RecordType) IsManagement() bool {
+	return t == TypeGetValues || t == TypeGetValuesResult || t == TypeUnknownType
+}
+
+// Role for fastcgi application in spec
+type Role uint16
+
+// Roles specified in the fastcgi spec
+const (
+	RoleResponder Role = iota + 1
+	RoleAuthorizer
+	RoleFilter
+)
+
+// FlagKeepConn is the flag of FCGI_BEGIN_REQUEST to keep the
+// connection between web-server and application open after
+// the request (FCGI_KEEP_CONN)
+const FlagKeepConn uint8 = 1
+
+// ProtocolStatus is the protocolStatus component of
+// FCGI_END_REQUEST record, as defined by
+// http://www.mit.edu/~yandros/doc/specs/fcgi-spec.html#S5.5
+type ProtocolStatus uint8
+
+// Protocol status specified in the fastcgi spec
+const (
+	StatusRequestComplete ProtocolStatus = iota
+	StatusCantMultiplex
+	StatusOverloaded
+	StatusUnknownRole
+)
+
+// String implements fmt.Stringer
+func (s ProtocolStatus) String() string {
+	switch s {
+	case StatusRequestComplete:
+		return "FCGI_REQUEST_COMPLETE"
+	case StatusCantMultiplex:
+		return "FCGI_CANT_MPX_CONN"
+	case StatusOverloaded:
+		return "FCGI_OVERLOADED"
+	case StatusUnknownRole:
+		return "FCGI_UNKNOWN_ROLE"
+	}
+	return fmt.Sprintf("FCGI_UNKNOWN_STATUS(%d)", uint8(s))
+}
+
+// Header is the header of a record
+type Header struct {
+	Version       uint8
+	Type          RecordType
+	ID            uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// Record is a FastCGI record
+type Record struct {
+	Header  Header
+	Content []byte
+}
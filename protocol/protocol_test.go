@@ -0,0 +1,164 @@
+package protocol_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/yookoala/gofast/protocol"
+)
+
+func TestWriterReader(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := protocol.NewWriter(buf)
+	if err := w.WriteBody(protocol.TypeBeginRequest, 1, protocol.BeginRequest{
+		Role:  protocol.RoleFilter,
+		Flags: protocol.FlagKeepConn,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sw := protocol.NewStreamWriter(w, protocol.TypeStdin, 1)
+	if _, err := sw.Write(bytes.Repeat([]byte("a"), protocol.MaxContentLength+3)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := protocol.ErrContentTooLong, w.WriteRecord(protocol.TypeStdout, 1, make([]byte, protocol.MaxContentLength+1)); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	r := protocol.NewReader(buf)
+	rec, err := r.ReadRecord()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := (protocol.Header{
+		Version:       protocol.Version,
+		Type:          protocol.TypeBeginRequest,
+		ID:            1,
+		ContentLength: 8,
+	}), rec.Header; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	var br protocol.BeginRequest
+	if err := br.UnmarshalBinary(rec.Content); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := protocol.RoleFilter, br.Role; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := true, br.KeepConn(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// stream is split into records, padded to 8 bytes,
+	// and terminated by an empty record
+	for _, length := range []int{protocol.MaxContentLength, 3, 0} {
+		rec, err := r.ReadRecord()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if want, have := protocol.TypeStdin, rec.Header.Type; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		if want, have := length, len(rec.Content); want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		if want, have := 0, (length+int(rec.Header.PaddingLength))%8; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	}
+	if _, err := r.ReadRecord(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %#v", err)
+	}
+}
+
+func TestReader_errors(t *testing.T) {
+	_, err := protocol.NewReader(bytes.NewReader([]byte{2, 1, 0, 1, 0, 0, 0, 0})).ReadRecord()
+	if verr, ok := err.(*protocol.VersionError); !ok {
+		t.Errorf("expected *protocol.VersionError, got %#v", err)
+	} else if want, have := uint8(2), verr.Version; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	_, err = protocol.NewReader(bytes.NewReader([]byte{1, 6, 0, 1, 0, 5, 3, 0, 'a', 'b'})).ReadRecord()
+	if want, have := (&protocol.TruncatedError{Type: protocol.TypeStdout, Want: 8, Have: 2}), err; !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	_, err = protocol.NewReader(bytes.NewReader([]byte{1, 6, 0})).ReadRecord()
+	if want, have := io.ErrUnexpectedEOF, err; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	var er protocol.EndRequest
+	err = er.UnmarshalBinary([]byte{0, 0})
+	if want, have := (&protocol.TruncatedError{Type: protocol.TypeEndRequest, Want: 8, Have: 2}), err; !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestBodies(t *testing.T) {
+	er := protocol.EndRequest{AppStatus: 1 << 20, ProtocolStatus: protocol.StatusOverloaded}
+	b, _ := er.MarshalBinary()
+	var erRead protocol.EndRequest
+	if err := erRead.UnmarshalBinary(b); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := er, erRead; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	ut := protocol.UnknownType{Type: protocol.RecordType(42)}
+	b, _ = ut.MarshalBinary()
+	var utRead protocol.UnknownType
+	if err := utRead.UnmarshalBinary(b); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := ut, utRead; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestPairs(t *testing.T) {
+	long := strings.Repeat("x", 200)
+	pairs := protocol.Pairs{
+		{Name: "SCRIPT_NAME", Value: "/index.php"},
+		{Name: "HTTP_X_LONG", Value: long},
+		{Name: "HTTP_X_FOO", Value: ""},
+		{Name: "SCRIPT_NAME", Value: "/other.php"},
+	}
+	b, err := pairs.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// short length in 1 byte, long length in 4 bytes
+	if want, have := []byte("\x0b\x0aSCRIPT_NAME/index.php\x0b\x80\x00\x00\xc8HTTP_X_LONG"), b[:39]; !bytes.Equal(want, have) {
+		t.Errorf("expected %q, got %q", want, have)
+	}
+
+	var read protocol.Pairs
+	if err := read.UnmarshalBinary(b); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := pairs, read; !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "/index.php", read.Map()["SCRIPT_NAME"]; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// truncated pairs
+	read = nil
+	err = read.UnmarshalBinary(b[:len(b)-1])
+	if _, ok := err.(*protocol.TruncatedError); !ok {
+		t.Errorf("expected *protocol.TruncatedError, got %#v", err)
+	}
+	if want, have := pairs[:3], read; !reflect.DeepEqual(want, have) {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Reader reads records from a stream
+type Reader struct {
+	r   io.Reader
+	buf [HeaderLength + MaxContentLength + MaxPaddingLength]byte
+}
+
+// NewReader returns a Reader that reads from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadRecord reads the next record.
+//
+// The Content of the returned record is only valid until the
+// next call of ReadRecord. It returns io.EOF if the stream ends
+// cleanly before a record, io.ErrUnexpectedEOF if it ends in the
+// middle of a header, and *TruncatedError if it ends in the
+// middle of the content or padding.
+func (r *Reader) ReadRecord() (rec Record, err error) {
+	if _, err = io.ReadFull(r.r, r.buf[:HeaderLength]); err != nil {
+		return
+	}
+	rec.Header = Header{
+		Version:       r.buf[0],
+		Type:          RecordType(r.buf[1]),
+		ID:            binary.BigEndian.Uint16(r.buf[2:]),
+		ContentLength: binary.BigEndian.Uint16(r.buf[4:]),
+		PaddingLength: r.buf[6],
+		Reserved:      r.buf[7],
+	}
+	if rec.Header.Version != Version {
+		err = &VersionError{Version: rec.Header.Version}
+		return
+	}
+
+	n := int(rec.Header.ContentLength) + int(rec.Header.PaddingLength)
+	body := r.buf[HeaderLength : HeaderLength+n]
+	if have, rerr := io.ReadFull(r.r, body); rerr != nil {
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			err = &TruncatedError{Type: rec.Header.Type, Want: n, Have: have}
+			return
+		}
+		err = rerr
+		return
+	}
+	rec.Content = body[:rec.Header.ContentLength]
+	return
+}
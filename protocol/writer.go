@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"encoding"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// for padding so we don't have to allocate all the time
+// not synchronized because we don't care what the contents are
+var pad [MaxPaddingLength]byte
+
+// Writer writes records to a stream. It is safe for concurrent
+// use. Each record is sent with a single Write call, so records
+// of different requests never interleave.
+type Writer struct {
+	mutex sync.Mutex
+	w     io.Writer
+
+	// to avoid allocations
+	buf []byte
+}
+
+// NewWriter returns a Writer that writes to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteRecord writes a single record of the given type, request
+// ID and content. The content is padded to a multiple of 8 bytes.
+func (w *Writer) WriteRecord(recType RecordType, reqID uint16, content []byte) error {
+	if len(content) > MaxContentLength {
+		return ErrContentTooLong
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	paddingLength := -len(content) & 7
+	w.buf = append(w.buf[:0],
+		Version, byte(recType), 0, 0, 0, 0, byte(paddingLength), 0)
+	binary.BigEndian.PutUint16(w.buf[2:], reqID)
+	binary.BigEndian.PutUint16(w.buf[4:], uint16(len(content)))
+	w.buf = append(w.buf, content...)
+	w.buf = append(w.buf, pad[:paddingLength]...)
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// WriteBody writes a single record with the encoded body
+// (e.g. BeginRequest, EndRequest, UnknownType or Pairs).
+func (w *Writer) WriteBody(recType RecordType, reqID uint16, body encoding.BinaryMarshaler) error {
+	content, err := body.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return w.WriteRecord(recType, reqID, content)
+}
+
+// StreamWriter separates a stream (e.g. FCGI_STDIN or FCGI_STDOUT)
+// of a request into records of at most MaxContentLength bytes.
+//
+// StreamWriter does not buffer. Wrap it with bufio.Writer to
+// avoid sending small records.
+type StreamWriter struct {
+	w       *Writer
+	recType RecordType
+	reqID   uint16
+}
+
+// NewStreamWriter returns a StreamWriter of the given stream
+// type and request ID.
+func NewStreamWriter(w *Writer, recType RecordType, reqID uint16) *StreamWriter {
+	return &StreamWriter{w: w, recType: recType, reqID: reqID}
+}
+
+// Write implements io.Writer
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	nn := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > MaxContentLength {
+			n = MaxContentLength
+		}
+		if err := sw.w.WriteRecord(sw.recType, sw.reqID, p[:n]); err != nil {
+			return nn, err
+		}
+		nn += n
+		p = p[n:]
+	}
+	return nn, nil
+}
+
+// Close sends the empty record that ends the stream
+func (sw *StreamWriter) Close() error {
+	return sw.w.WriteRecord(sw.recType, sw.reqID, nil)
+}
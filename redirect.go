@@ -0,0 +1,127 @@
+package gofast
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// LocalRedirect configures how a Handler follows the local redirect
+// responses of the application (RFC 3875, 6.2.2), i.e. a Location
+// of a path without a Status. The Handler serves the path itself,
+// instead of redirecting the client with 302 Found.
+//
+// The redirected request is a GET request of the path, with the
+// headers of the original request. Its parameters include those of
+// the original request, prefixed with "REDIRECT_" (e.g.
+// REDIRECT_REQUEST_URI), and REDIRECT_URL of the original path.
+type LocalRedirect struct {
+	// Handler serves the redirected request. If nil, it is served
+	// by the same Handler (i.e. the same SessionHandler chain).
+	Handler http.Handler
+
+	// MaxDepth is the maximum number of local redirects of a
+	// request. Beyond that, the Handler responds with 500 Internal
+	// Server Error. Zero disables following local redirects.
+	MaxDepth int
+}
+
+// WithLocalRedirect sets how the Handler follows local redirects.
+func WithLocalRedirect(redirect LocalRedirect) HandlerOption {
+	return func(h *defaultHandler) {
+		h.redirect = redirect
+	}
+}
+
+// isLocalLocation reports if the location is of a local
+// redirect (an absolute path, not a network-path reference).
+func isLocalLocation(loc string) bool {
+	return strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//")
+}
+
+// redirectKey is the context key of the redirectInfo
+// of a redirected request
+type redirectKey struct{}
+
+// redirectInfo is the local redirect of a request
+type redirectInfo struct {
+	depth  int
+	params map[string]string
+}
+
+// setRedirectParams sets the parameters of the local redirect of
+// the request, if it is redirected.
+func setRedirectParams(req *Request) {
+	if req.Raw == nil {
+		return
+	}
+	if info, ok := req.Raw.Context().Value(redirectKey{}).(*redirectInfo); ok {
+		for name, value := range info.params {
+			req.Params.Set(name, value)
+		}
+	}
+}
+
+// localRedirect serves the local redirect of the request to loc.
+func (h *defaultHandler) localRedirect(w http.ResponseWriter, r *http.Request, req *Request, loc string) {
+	depth := 1
+	if info, ok := r.Context().Value(redirectKey{}).(*redirectInfo); ok {
+		depth = info.depth + 1
+	}
+	if depth > h.redirect.MaxDepth {
+		http.Error(w, "too many local redirects", http.StatusInternalServerError)
+		h.logf("gofast: too many local redirects to %s", loc)
+		return
+	}
+
+	u, err := url.Parse(loc)
+	if err != nil {
+		http.Error(w, "invalid local redirect", http.StatusInternalServerError)
+		h.logf("gofast: invalid local redirect to %s: %s", loc, err)
+		return
+	}
+
+	// parameters of the original request
+	params := map[string]string{
+		"REDIRECT_STATUS": strconv.Itoa(http.StatusOK),
+		"REDIRECT_URL":    r.URL.Path,
+	}
+	for name, value := range req.Params.Map() {
+		if !strings.HasPrefix(name, "REDIRECT_") {
+			params["REDIRECT_"+name] = value
+		}
+	}
+
+	redirected := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		RequestURI: loc,
+		TLS:        r.TLS,
+	}
+	for name, values := range r.Header {
+		switch name {
+		case "Content-Length", "Content-Type":
+			continue
+		}
+		redirected.Header[name] = append([]string(nil), values...)
+	}
+	redirected = redirected.WithContext(context.WithValue(r.Context(), redirectKey{}, &redirectInfo{
+		depth:  depth,
+		params: params,
+	}))
+
+	if h.redirect.Handler != nil {
+		h.redirect.Handler.ServeHTTP(w, redirected)
+		return
+	}
+	h.ServeHTTP(w, redirected)
+}
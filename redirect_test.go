@@ -0,0 +1,112 @@
+package gofast_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yookoala/gofast"
+	"github.com/yookoala/gofast/protocol"
+)
+
+// newCGIApp returns a dummy application that responds to each
+// request with the raw CGI response returned by fn
+func newCGIApp(t *testing.T, fn func(params map[string]string) string) net.Listener {
+	l, _ := newRawApp(t, func(conn net.Conn) {
+		r, w := protocol.NewReader(conn), protocol.NewWriter(conn)
+		var params []byte
+		for {
+			rec, err := r.ReadRecord()
+			if err != nil {
+				return
+			}
+			switch rec.Header.Type {
+			case protocol.TypeParams:
+				params = append(params, rec.Content...)
+			case protocol.TypeStdin:
+				if len(rec.Content) > 0 {
+					continue
+				}
+				var pairs protocol.Pairs
+				pairs.UnmarshalBinary(params)
+				sw := protocol.NewStreamWriter(w, protocol.TypeStdout, rec.Header.ID)
+				io.WriteString(sw, fn(pairs.Map()))
+				sw.Close()
+				w.WriteBody(protocol.TypeEndRequest, rec.Header.ID, protocol.EndRequest{})
+				return
+			}
+		}
+	})
+	return l
+}
+
+// newRedirectApp returns a dummy application that redirects
+// /old locally to /new
+func newRedirectApp(t *testing.T) net.Listener {
+	return newCGIApp(t, func(params map[string]string) string {
+		switch params["REQUEST_URI"] {
+		case "/old":
+			return "Location: /new?from=old\r\n\r\n"
+		case "/loop":
+			return "Location: /loop\r\n\r\n"
+		}
+		return fmt.Sprintf("Content-Type: text/plain\r\n\r\n%s %s %s",
+			params["REQUEST_URI"], params["REDIRECT_REQUEST_URI"], params["REDIRECT_URL"])
+	})
+}
+
+func newRedirectHandler(l net.Listener, redirect gofast.LocalRedirect) http.Handler {
+	return newServerHandler(l, gofast.WithLocalRedirect(redirect))
+}
+
+func TestHandler_localRedirect(t *testing.T) {
+	l := newRedirectApp(t)
+	defer l.Close()
+
+	w := httptest.NewRecorder()
+	newRedirectHandler(l, gofast.LocalRedirect{MaxDepth: 1}).ServeHTTP(w, httptest.NewRequest("POST", "/old", nil))
+	if want, have := http.StatusOK, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "/new?from=old /old /old", w.Body.String(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// redirected by the client if disabled
+	w = httptest.NewRecorder()
+	newRedirectHandler(l, gofast.LocalRedirect{}).ServeHTTP(w, httptest.NewRequest("GET", "/old", nil))
+	if want, have := http.StatusFound, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "/new?from=old", w.Header().Get("Location"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestHandler_localRedirectDepth(t *testing.T) {
+	l := newRedirectApp(t)
+	defer l.Close()
+
+	var served int32
+	var h http.Handler
+	h = newServerHandler(l, gofast.WithLocalRedirect(gofast.LocalRedirect{
+		MaxDepth: 3,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&served, 1)
+			h.ServeHTTP(w, r)
+		}),
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/loop", nil))
+	if want, have := http.StatusInternalServerError, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := int32(3), atomic.LoadInt32(&served); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
@@ -0,0 +1,135 @@
+package gofast
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Response reads the CGI response header of the application and
+// returns it as a *http.Response, for use outside an http.Handler
+// (e.g. in workers or tests). The Status header is the status of the
+// response, with its reason phrase kept. The Body streams the rest of
+// the output, and should be closed. Closing it before the end of the
+// output aborts the request.
+//
+// The error stream of the application is copied to ew, if not nil,
+// until the Body is read to the end. If the request failed (see
+// Err), reading the Body returns the error instead of io.EOF.
+//
+// If the request failed before the header was complete, it returns
+// the error of the request. If the header is invalid, it returns
+// *HeaderError.
+func (pipes *ResponsePipe) Response(ew io.Writer) (resp *http.Response, err error) {
+	if ew == nil {
+		ew = ioutil.Discard
+	}
+	errDone := make(chan struct{})
+	go func() {
+		defer close(errDone)
+		pipes.writeError(ew)
+	}()
+
+	linebody := bufio.NewReader(pipes.stdOutReader)
+	h, err := readResponseHeader(linebody, pipes.headerLimits)
+	if err == io.ErrUnexpectedEOF {
+		// the request may have failed without any output
+		if err = pipes.Err(); err == nil {
+			err = &HeaderError{Msg: "no end of headers"}
+		}
+	} else if _, ok := err.(*HeaderError); err != nil && !ok {
+		err = fmt.Errorf("gofast: error reading headers: %v", err)
+	}
+	if err == nil && h.status == 0 {
+		switch {
+		case h.header.Get("Location") != "":
+			h.status = http.StatusFound
+		case h.header.Get("Content-Type") == "":
+			err = &HeaderError{Msg: "missing required Content-Type"}
+		default:
+			h.status = http.StatusOK
+		}
+	}
+	if err != nil {
+		io.Copy(ioutil.Discard, linebody)
+		<-errDone
+		return
+	}
+
+	statusText := h.statusText
+	if statusText == "" {
+		statusText = http.StatusText(h.status)
+	}
+	contentLength := int64(-1)
+	if cl, err := strconv.ParseInt(h.header.Get("Content-Length"), 10, 64); err == nil && cl >= 0 {
+		contentLength = cl
+	}
+
+	resp = &http.Response{
+		Status:        fmt.Sprintf("%03d %s", h.status, statusText),
+		StatusCode:    h.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h.header,
+		ContentLength: contentLength,
+		Body: &responseBody{
+			r:       linebody,
+			pipes:   pipes,
+			errDone: errDone,
+		},
+	}
+	return
+}
+
+// errBodyClosed is returned by reading a closed response body
+var errBodyClosed = errors.New("gofast: read on closed response body")
+
+// responseBody is the Body of the *http.Response of a ResponsePipe
+type responseBody struct {
+	r       io.Reader
+	pipes   *ResponsePipe
+	errDone <-chan struct{}
+
+	// mutex guards closed
+	mutex  sync.Mutex
+	closed bool
+	once   sync.Once
+}
+
+// Read implements io.Reader. At the end of the output, it waits
+// for the error stream to be copied, and returns the error of the
+// request, if any.
+func (b *responseBody) Read(p []byte) (n int, err error) {
+	b.mutex.Lock()
+	closed := b.closed
+	b.mutex.Unlock()
+	if closed {
+		return 0, errBodyClosed
+	}
+	n, err = b.r.Read(p)
+	if err == io.EOF {
+		<-b.errDone
+		if rerr := b.pipes.Err(); rerr != nil {
+			err = rerr
+		}
+	}
+	return
+}
+
+// Close implements io.Closer. The rest of the output is
+// discarded, and the request is ended if not yet.
+func (b *responseBody) Close() error {
+	b.once.Do(func() {
+		b.mutex.Lock()
+		b.closed = true
+		b.mutex.Unlock()
+		b.pipes.discard()
+	})
+	return nil
+}
@@ -0,0 +1,234 @@
+package gofast_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yookoala/gofast"
+	"github.com/yookoala/gofast/protocol"
+)
+
+// newStderrApp returns a dummy application that writes stderr
+// before responding with stdout
+func newStderrApp(t *testing.T, stdout, stderr string) net.Listener {
+	l, _ := newRawApp(t, func(conn net.Conn) {
+		r, w := protocol.NewReader(conn), protocol.NewWriter(conn)
+		for {
+			rec, err := r.ReadRecord()
+			if err != nil {
+				return
+			}
+			if rec.Header.Type != protocol.TypeStdin || len(rec.Content) > 0 {
+				continue
+			}
+			ew := protocol.NewStreamWriter(w, protocol.TypeStderr, rec.Header.ID)
+			io.WriteString(ew, stderr)
+			ew.Close()
+			sw := protocol.NewStreamWriter(w, protocol.TypeStdout, rec.Header.ID)
+			io.WriteString(sw, stdout)
+			sw.Close()
+			w.WriteBody(protocol.TypeEndRequest, rec.Header.ID, protocol.EndRequest{})
+			return
+		}
+	})
+	return l
+}
+
+func doResponse(t *testing.T, l net.Listener, ew io.Writer) (*http.Response, error) {
+	c, err := gofast.SimpleClientFactory(
+		gofast.SimpleConnFactory("tcp", l.Addr().String()),
+	)()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp, err := c.Do(gofast.NewRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return resp.Response(ew)
+}
+
+func TestResponsePipe_Response(t *testing.T) {
+	tests := []struct {
+		desc   string
+		output string
+		status string
+		code   int
+		length int64
+		body   string
+	}{
+		{
+			desc:   "default status",
+			output: "Content-Type: text/plain\r\n\r\nhello",
+			status: "200 OK",
+			code:   http.StatusOK,
+			length: -1,
+			body:   "hello",
+		},
+		{
+			desc:   "reason phrase kept",
+			output: "Status: 418 Short and Stout\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello",
+			status: "418 Short and Stout",
+			code:   http.StatusTeapot,
+			length: 5,
+			body:   "hello",
+		},
+		{
+			desc:   "status without reason phrase",
+			output: "Status: 404\r\nContent-Type: text/plain\r\n\r\n",
+			status: "404 Not Found",
+			code:   http.StatusNotFound,
+			length: -1,
+		},
+		{
+			desc:   "redirect",
+			output: "Location: http://example.com/\r\n\r\n",
+			status: "302 Found",
+			code:   http.StatusFound,
+			length: -1,
+		},
+	}
+
+	for _, test := range tests {
+		l := newCGIApp(t, func(params map[string]string) string {
+			return test.output
+		})
+		resp, err := doResponse(t, l, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.desc, err)
+			l.Close()
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		l.Close()
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.desc, err)
+		}
+		if want, have := test.status, resp.Status; want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := test.code, resp.StatusCode; want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := test.length, resp.ContentLength; want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := test.body, string(body); want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.desc, want, have)
+		}
+		if have := resp.Header.Get("Status"); have != "" {
+			t.Errorf("%s: expected Status header stripped, got %#v", test.desc, have)
+		}
+	}
+}
+
+func TestResponsePipe_ResponseStderr(t *testing.T) {
+	l := newStderrApp(t, "Content-Type: text/plain\r\n\r\nhello", "some warning")
+	defer l.Close()
+
+	ew := new(bytes.Buffer)
+	resp, err := doResponse(t, l, ew)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := "hello", string(body); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "some warning", ew.String(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestResponsePipe_ResponseError(t *testing.T) {
+	// invalid header
+	l := newCGIApp(t, func(params map[string]string) string {
+		return "X-Foo: a\r\n\r\nhello"
+	})
+	defer l.Close()
+	_, err := doResponse(t, l, nil)
+	if _, ok := err.(*gofast.HeaderError); !ok {
+		t.Errorf("expected *gofast.HeaderError, got %#v", err)
+	}
+
+	// rejected by the application
+	l2, _ := newRawApp(t, overloadedApp)
+	defer l2.Close()
+	_, err = doResponse(t, l2, nil)
+	if want, have := gofast.ErrOverloaded, err; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestResponsePipe_ResponseClose(t *testing.T) {
+	// the application writes until the request is aborted
+	aborted := make(chan struct{})
+	srv := &gofast.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(aborted)
+			w.Header().Set("Content-Type", "text/plain")
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(time.Millisecond):
+				}
+				io.WriteString(w, "hello")
+				w.(http.Flusher).Flush()
+			}
+		}),
+	}
+	l, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	c, err := gofast.SimpleClientFactory(gofast.SimpleConnFactory("tcp", l.Addr().String()))()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	req := gofast.NewRequest(nil)
+	req.Params.Set("REQUEST_METHOD", "GET")
+	req.Params.Set("SERVER_PROTOCOL", "HTTP/1.1")
+	req.Params.Set("REQUEST_URI", "/")
+	pipes, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp, err := pipes.Response(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// closing twice is fine, reading after close is not
+	done := make(chan struct{})
+	go func() {
+		resp.Body.Close()
+		close(done)
+	}()
+	resp.Body.Close()
+	<-done
+	if _, err := resp.Body.Read(buf); err == nil {
+		t.Errorf("expected error reading closed body")
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Errorf("expected the request to be aborted")
+	}
+}
@@ -0,0 +1,283 @@
+package gofast
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+)
+
+// RetryCondition is a set of failures of a request that are safe
+// to retry on another client (like fastcgi_next_upstream of nginx).
+type RetryCondition uint
+
+// Conditions to retry a request
+const (
+	// RetryDial retries if creating the client failed
+	// (e.g. connection refused).
+	RetryDial RetryCondition = 1 << iota
+
+	// RetryConnError retries if the connection broke (*ConnError)
+	// before any output of the application.
+	RetryConnError
+
+	// RetryOverloaded retries if the application rejected the
+	// request with FCGI_OVERLOADED or FCGI_CANT_MPX_CONN.
+	RetryOverloaded
+
+	// RetryDefault retries on all the conditions above.
+	//
+	// Requests are only retried if the request body has not been
+	// consumed, or can be replayed (see RetryConfig.BufferBody).
+	RetryDefault = RetryDial | RetryConnError | RetryOverloaded
+)
+
+// DefaultRetryTries is the default number of tries of a request.
+const DefaultRetryTries = 3
+
+// RetryConfig configures the retrying of requests.
+type RetryConfig struct {
+	// Conditions to retry on. If zero, RetryDefault is used.
+	Conditions RetryCondition
+
+	// Tries is the maximum number of tries, including the
+	// first one. If zero, DefaultRetryTries is used.
+	Tries int
+
+	// Timeout limits the time to start another try, counted
+	// from the first one. Zero means no limit.
+	Timeout time.Duration
+
+	// BufferBody is the maximum size of the request body kept
+	// in memory to be replayed on retry. A request with its body
+	// partly sent is never retried, unless the sent part is kept.
+	// Zero means the body is never kept.
+	BufferBody int64
+}
+
+// withDefaults returns the config with default values filled in.
+func (config RetryConfig) withDefaults() RetryConfig {
+	if config.Conditions == 0 {
+		config.Conditions = RetryDefault
+	}
+	if config.Tries <= 0 {
+		config.Tries = DefaultRetryTries
+	}
+	return config
+}
+
+// retryable reports if another try can be started after the
+// given number of tries, since start.
+func (config RetryConfig) retryable(ctx context.Context, tries int, start time.Time) bool {
+	if tries >= config.Tries || ctx.Err() != nil {
+		return false
+	}
+	return config.Timeout <= 0 || time.Since(start) < config.Timeout
+}
+
+// RetryClientFactory returns a ContextClientFactory that retries
+// creating the client from factory if it failed, when RetryDial
+// is in the conditions of config.
+//
+// Use it as the client factory of a Handler, with a factory that
+// can return a different connection (e.g. Balancer.CreateClientContext).
+func RetryClientFactory(factory ContextClientFactory, config RetryConfig) ContextClientFactory {
+	config = config.withDefaults()
+	return func(ctx context.Context) (c Client, err error) {
+		start := time.Now()
+		for tries := 1; ; tries++ {
+			c, err = factory(ctx)
+			if err == nil || err == ErrPoolClosed ||
+				config.Conditions&RetryDial == 0 ||
+				!config.retryable(ctx, tries, start) {
+				return
+			}
+		}
+	}
+}
+
+// Retry returns a Middleware that retries the request on a new client
+// from factory (e.g. Balancer.CreateClientContext, to try another
+// backend), if it failed on the conditions of config.
+//
+// To tell if a request failed before any output, the inner
+// SessionHandler returns only after the first output of the
+// application. The middleware should be the innermost one (i.e.
+// wrapping BasicSession), so the request is only sent again.
+//
+// The clients created for retries are closed when their responses
+// are done. The client given is left to the caller.
+func Retry(factory ContextClientFactory, config RetryConfig) Middleware {
+	config = config.withDefaults()
+	return func(inner SessionHandler) SessionHandler {
+		return func(client Client, req *Request) (resp *ResponsePipe, err error) {
+			ctx := req.Context()
+			start := time.Now()
+
+			var body *retryBody
+			if req.Stdin != nil {
+				body = &retryBody{ReadCloser: req.Stdin, limit: config.BufferBody}
+				req.Stdin = body
+			}
+
+			var created Client
+			for tries := 1; ; tries++ {
+				if tries > 1 {
+					c, dialErr := factory(ctx)
+					if dialErr != nil {
+						if config.Conditions&RetryDial != 0 && config.retryable(ctx, tries, start) {
+							continue
+						}
+						// give the result of the last try
+						break
+					}
+					client, created = c, c
+				}
+
+				resp, err = inner(client, req)
+				last := !config.retryable(ctx, tries, start)
+				if err == nil && !last && config.Conditions&(RetryConnError|RetryOverloaded) != 0 {
+					err = resp.peek()
+				}
+				if last || !config.retry(err, body) {
+					break
+				}
+				if created != nil {
+					created.Close()
+					created = nil
+				}
+			}
+
+			if resp != nil {
+				// the error, if any, is reported by the response
+				err = nil
+			}
+			release(created, body, resp)
+			return
+		}
+	}
+}
+
+// retry reports if the request failed with err should be retried.
+func (config RetryConfig) retry(err error, body *retryBody) bool {
+	switch err.(type) {
+	case nil:
+		return false
+	case *ConnError:
+		if config.Conditions&RetryConnError == 0 {
+			return false
+		}
+	default:
+		if err != ErrOverloaded || config.Conditions&RetryOverloaded == 0 {
+			return false
+		}
+	}
+	return body.rewind()
+}
+
+// release closes the client created for a retry and the request
+// body when the response is done, or immediately if there is no
+// response.
+func release(c Client, body *retryBody, resp *ResponsePipe) {
+	closeAll := func() {
+		if c != nil {
+			c.Close()
+		}
+		if body != nil {
+			body.ReadCloser.Close()
+		}
+	}
+	if resp == nil {
+		closeAll()
+		return
+	}
+	go func() {
+		<-resp.done
+		closeAll()
+	}()
+}
+
+// peek waits for the first output of the application. If the
+// request ended without any output, it returns the error of the
+// request. Otherwise, the output is kept to be read again and the
+// error stream is buffered meanwhile.
+func (pipes *ResponsePipe) peek() error {
+	stdErr, errReader := newStreamBuffer(), pipes.stdErrReader
+	go func() {
+		_, err := io.Copy(stdErr, errReader)
+		if err == nil {
+			err = io.EOF
+		}
+		stdErr.closeWrite(err)
+	}()
+	pipes.stdErrReader = stdErr
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := pipes.stdOutReader.Read(buf)
+		if n > 0 {
+			pipes.stdOutReader = io.MultiReader(bytes.NewReader(buf[:n]), pipes.stdOutReader)
+			return nil
+		}
+		if err != nil {
+			return pipes.Err()
+		}
+	}
+}
+
+// retryBody is a request body that can be replayed on retry, if
+// it has not been read, or if the read part is kept.
+//
+// It is not closed by the client, as it may be sent again. The
+// underlying body is closed when the last response is done.
+type retryBody struct {
+	io.ReadCloser
+
+	limit    int64
+	buf      []byte // the read part of the body, if kept
+	pos      int    // read position in buf of the current try
+	consumed bool
+	overflow bool
+}
+
+// Read implements io.Reader
+func (b *retryBody) Read(p []byte) (n int, err error) {
+	if b.pos < len(b.buf) {
+		n = copy(p, b.buf[b.pos:])
+		b.pos += n
+		return
+	}
+	n, err = b.ReadCloser.Read(p)
+	if n == 0 {
+		return
+	}
+	b.consumed = true
+	if b.overflow {
+		return
+	}
+	if int64(len(b.buf)+n) > b.limit {
+		b.overflow, b.buf, b.pos = true, nil, 0
+		return
+	}
+	b.buf = append(b.buf, p[:n]...)
+	b.pos = len(b.buf)
+	return
+}
+
+// Close implements io.Closer. The body is left open.
+func (b *retryBody) Close() error {
+	return nil
+}
+
+// rewind rewinds the body for another try. It reports false
+// if the body cannot be replayed.
+func (b *retryBody) rewind() bool {
+	if b == nil || !b.consumed {
+		return true
+	}
+	if b.overflow {
+		return false
+	}
+	b.pos = 0
+	return true
+}
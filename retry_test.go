@@ -0,0 +1,207 @@
+package gofast_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yookoala/gofast"
+)
+
+// newRawApp returns a dummy application that handles every
+// connection with fn, and counts the connections
+func newRawApp(t *testing.T, fn func(conn net.Conn)) (l net.Listener, count *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	count = new(int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(count, 1)
+			go func() {
+				defer conn.Close()
+				fn(conn)
+			}()
+		}
+	}()
+	return
+}
+
+// overloadedApp rejects the request with FCGI_OVERLOADED
+func overloadedApp(conn net.Conn) {
+	h := make([]byte, 8)
+	if _, err := io.ReadFull(conn, h); err != nil {
+		return
+	}
+	conn.Write([]byte{
+		1, 3, h[2], h[3], 0, 8, 0, 0, // FCGI_END_REQUEST header
+		0, 0, 0, 0, 2, 0, 0, 0, // FCGI_OVERLOADED
+	})
+}
+
+// brokenApp closes the connection after reading
+// the first FCGI_STDIN record with content
+func brokenApp(conn net.Conn) {
+	h := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(conn, h); err != nil {
+			return
+		}
+		length := int64(h[4])<<8 | int64(h[5]) + int64(h[6])
+		if _, err := io.CopyN(ioutil.Discard, conn, length); err != nil {
+			return
+		}
+		if h[1] == 5 && length > 0 {
+			return
+		}
+	}
+}
+
+// newEchoApp returns a gofast Server that echoes the request body
+func newEchoApp(t *testing.T) (*gofast.Server, net.Listener) {
+	srv := &gofast.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "echo: ")
+			io.Copy(w, r.Body)
+		}),
+	}
+	l, _ := newServerApp(t, srv)
+	return srv, l
+}
+
+// newRetryHandler returns a handler of the backends which
+// retries by the config
+func newRetryHandler(t *testing.T, config gofast.RetryConfig, addrs ...string) (http.Handler, *gofast.Balancer) {
+	var backends []gofast.Backend
+	for _, addr := range addrs {
+		backends = append(backends, gofast.NewBackend("tcp", addr, 1, gofast.PoolConfig{}))
+	}
+	b, err := gofast.NewBalancer(gofast.RoundRobin, backends...)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return gofast.NewContextHandler(
+		gofast.Chain(
+			gofast.BasicParamsMap,
+			gofast.MapHeader,
+			gofast.Retry(b.CreateClientContext, config),
+		)(gofast.BasicSession),
+		gofast.RetryClientFactory(b.CreateClientContext, config),
+	), b
+}
+
+func TestRetry_overloaded(t *testing.T) {
+	srv, good := newEchoApp(t)
+	defer srv.Close()
+	bad, count := newRawApp(t, overloadedApp)
+	defer bad.Close()
+
+	// the first pick of round-robin is the second backend
+	config := gofast.RetryConfig{BufferBody: 1024}
+	h, b := newRetryHandler(t, config, good.Addr().String(), bad.Addr().String())
+	defer b.Close()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+	if want, have := http.StatusOK, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "echo: hello", w.Body.String(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := int32(1), atomic.LoadInt32(count); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestRetry_tries(t *testing.T) {
+	bad, count := newRawApp(t, overloadedApp)
+	defer bad.Close()
+
+	h, b := newRetryHandler(t, gofast.RetryConfig{Tries: 2}, bad.Addr().String())
+	defer b.Close()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if want, have := http.StatusServiceUnavailable, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := int32(2), atomic.LoadInt32(count); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestRetry_connError(t *testing.T) {
+	srv, good := newEchoApp(t)
+	defer srv.Close()
+	bad, count := newRawApp(t, brokenApp)
+	defer bad.Close()
+
+	t.Run("unbuffered", func(t *testing.T) {
+		h, b := newRetryHandler(t, gofast.RetryConfig{}, good.Addr().String(), bad.Addr().String())
+		defer b.Close()
+
+		// the body is partly sent, so not retried
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+		if want, have := http.StatusBadGateway, w.Code; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		if want, have := int32(1), atomic.LoadInt32(count); want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	})
+
+	t.Run("buffered", func(t *testing.T) {
+		h, b := newRetryHandler(t, gofast.RetryConfig{BufferBody: 1024}, good.Addr().String(), bad.Addr().String())
+		defer b.Close()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+		if want, have := http.StatusOK, w.Code; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		if want, have := "echo: hello", w.Body.String(); want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	})
+}
+
+func TestRetryClientFactory(t *testing.T) {
+	var dials int32
+	factory := func(ctx context.Context) (gofast.Client, error) {
+		if atomic.AddInt32(&dials, 1) < 3 {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return gofast.ClientFunc(nil), nil
+	}
+
+	if _, err := gofast.RetryClientFactory(factory, gofast.RetryConfig{})(context.Background()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if want, have := int32(3), atomic.LoadInt32(&dials); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// not retried without the condition
+	atomic.StoreInt32(&dials, 0)
+	config := gofast.RetryConfig{Conditions: gofast.RetryOverloaded}
+	if _, err := gofast.RetryClientFactory(factory, config)(context.Background()); err == nil {
+		t.Errorf("expected error")
+	}
+	if want, have := int32(1), atomic.LoadInt32(&dials); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
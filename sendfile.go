@@ -0,0 +1,134 @@
+package gofast
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Sendfile configures how a Handler serves the files of X-Sendfile
+// and X-Accel-Redirect response headers. Instead of piping the file
+// through the application, the application responds with the header
+// (e.g. after checking permissions) and the Handler serves the file
+// with http.ServeContent, which supports Range and conditional
+// requests. The other headers of the response (e.g.
+// Content-Disposition) are kept, and the body is discarded.
+type Sendfile struct {
+	// Roots are the directories the absolute paths of X-Sendfile
+	// are allowed in. If empty, X-Sendfile is not recognized.
+	Roots []string
+
+	// Accel maps the internal URI prefixes of X-Accel-Redirect to
+	// the file systems of the files (e.g. http.Dir of a directory),
+	// like the internal locations of nginx. The rest of the URI is
+	// opened in the file system. If empty, X-Accel-Redirect is not
+	// recognized.
+	Accel map[string]http.FileSystem
+}
+
+// WithSendfile sets how the Handler serves the files of
+// X-Sendfile and X-Accel-Redirect.
+func WithSendfile(sendfile Sendfile) HandlerOption {
+	return func(h *defaultHandler) {
+		h.sendfile = sendfile
+	}
+}
+
+// headers returns the response headers recognized by the config.
+func (s Sendfile) headers() (headers []string) {
+	if len(s.Roots) > 0 {
+		headers = append(headers, "X-Sendfile")
+	}
+	if len(s.Accel) > 0 {
+		headers = append(headers, "X-Accel-Redirect")
+	}
+	return
+}
+
+// open opens the file of the X-Sendfile path, if in the roots.
+func (s Sendfile) open(file string) (http.File, error) {
+	if !filepath.IsAbs(file) {
+		return nil, os.ErrPermission
+	}
+
+	// resolve symlinks, so they cannot lead out of the roots
+	file, err := filepath.EvalSymlinks(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range s.Roots {
+		if root, err = filepath.EvalSymlinks(filepath.Clean(root)); err != nil {
+			continue
+		}
+		if file == root || strings.HasPrefix(file, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return os.Open(file)
+		}
+	}
+	return nil, os.ErrPermission
+}
+
+// openAccel opens the file of the X-Accel-Redirect URI, in
+// the file system of its longest matching prefix.
+func (s Sendfile) openAccel(uri string) (http.File, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	prefixes := make([]string, 0, len(s.Accel))
+	for prefix := range s.Accel {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(prefixes)))
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(u.Path, prefix) {
+			return s.Accel[prefix].Open("/" + strings.TrimPrefix(u.Path[len(prefix):], "/"))
+		}
+	}
+	return nil, os.ErrPermission
+}
+
+// serveFile serves the file of the response header
+// (X-Sendfile or X-Accel-Redirect).
+func (h *defaultHandler) serveFile(w http.ResponseWriter, r *http.Request, header, file string) {
+	var f http.File
+	var err error
+	if header == "X-Sendfile" {
+		f, err = h.sendfile.open(file)
+	} else {
+		f, err = h.sendfile.openAccel(file)
+	}
+	if err != nil {
+		h.fileError(w, header, file, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		h.fileError(w, header, file, err)
+		return
+	}
+	if fi.IsDir() {
+		h.fileError(w, header, file, os.ErrPermission)
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// fileError responds the error of opening the file of
+// the response header.
+func (h *defaultHandler) fileError(w http.ResponseWriter, header, file string, err error) {
+	h.logf("gofast: unable to serve %s %s: %s", header, file, err)
+	w.Header().Del("Content-Disposition")
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,88 @@
+package gofast_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yookoala/gofast"
+)
+
+func TestHandler_sendfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofast-sendfile")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	files := filepath.Join(dir, "files")
+	os.Mkdir(files, 0755)
+	ioutil.WriteFile(filepath.Join(files, "hello.txt"), []byte("hello world"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644)
+
+	// the application responds with the header of the request URI
+	responses := map[string]string{
+		"/sendfile": "X-Sendfile: " + filepath.Join(files, "hello.txt") + "\r\n",
+		"/outside":  "X-Sendfile: " + filepath.Join(files, "..", "secret.txt") + "\r\n",
+		"/accel":    "X-Accel-Redirect: /protected/hello.txt\r\n",
+		"/missing":  "X-Accel-Redirect: /protected/../../secret.txt\r\n",
+	}
+	l := newCGIApp(t, func(params map[string]string) string {
+		return responses[params["REQUEST_URI"]] +
+			"Content-Type: text/plain\r\n" +
+			"Content-Disposition: attachment\r\n" +
+			"\r\nfrom application"
+	})
+	defer l.Close()
+
+	h := newServerHandler(l, gofast.WithSendfile(gofast.Sendfile{
+		Roots: []string{files},
+		Accel: map[string]http.FileSystem{
+			"/protected/": http.Dir(files),
+		},
+	}))
+
+	tests := []struct {
+		uri    string
+		header string
+		status int
+		body   string
+	}{
+		{"/sendfile", "", http.StatusOK, "hello world"},
+		{"/sendfile", "bytes=0-4", http.StatusPartialContent, "hello"},
+		{"/outside", "", http.StatusForbidden, "403 forbidden\n"},
+		{"/accel", "", http.StatusOK, "hello world"},
+		{"/missing", "", http.StatusNotFound, "404 page not found\n"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.uri, nil)
+		if test.header != "" {
+			r.Header.Set("Range", test.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if want, have := test.status, w.Code; want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.uri, want, have)
+		}
+		if want, have := test.body, w.Body.String(); want != have {
+			t.Errorf("%s: expected %#v, got %#v", test.uri, want, have)
+		}
+		if test.status == http.StatusOK {
+			if want, have := "attachment", w.Header().Get("Content-Disposition"); want != have {
+				t.Errorf("%s: expected %#v, got %#v", test.uri, want, have)
+			}
+		}
+		if have := w.Header().Get("X-Sendfile") + w.Header().Get("X-Accel-Redirect"); have != "" {
+			t.Errorf("%s: expected the header stripped, got %#v", test.uri, have)
+		}
+	}
+
+	// not recognized if not configured
+	w := httptest.NewRecorder()
+	newServerHandler(l).ServeHTTP(w, httptest.NewRequest("GET", "/sendfile", nil))
+	if want, have := "from application", w.Body.String(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
@@ -0,0 +1,850 @@
+// Copyright 2016 Yeung Shu Hung and The Go Authors.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file implements the application side for FastCGI
+// as specified in http://www.mit.edu/~yandros/doc/specs/fcgi-spec.html
+
+// A part of this file is from golang package net/http/fcgi,
+// in particular https://golang.org/src/net/http/fcgi/child.go
+
+package gofast
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"sync"
+	"time"
+
+	"github.com/yookoala/gofast/protocol"
+)
+
+// ErrServerClosed is returned by the Server's Serve method
+// after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("gofast: Server closed")
+
+// ErrRequestAborted is returned by Read when a handler attempts to read the
+// body of a request that has been aborted by the web server.
+var ErrRequestAborted = errors.New("gofast: request aborted by web server")
+
+// ErrConnClosed is returned by Read when a handler attempts to read the body of
+// a request after the connection to the web server has been closed.
+var ErrConnClosed = errors.New("gofast: connection to web server closed")
+
+// ErrRequestTooLarge is returned by Read when a handler attempts to read the
+// body of a request that exceeded the MaxRequestBuffer of the Server.
+var ErrRequestTooLarge = errors.New("gofast: request exceeds the buffer limit")
+
+// DefaultMaxRequestBuffer is the default MaxRequestBuffer of Server.
+const DefaultMaxRequestBuffer = 32 << 20
+
+// lingerTimeout is the maximum time to wait for the web server to
+// finish sending, before closing a connection.
+const lingerTimeout = 5 * time.Second
+
+// Serve accepts incoming FastCGI connections on the listener l, and
+// serves the given http.Handler as a FastCGI responder.
+// If handler is nil, http.DefaultServeMux is used.
+//
+// It is a shortcut of Server.Serve with default settings.
+func Serve(l net.Listener, handler http.Handler) error {
+	srv := &Server{Handler: handler}
+	return srv.Serve(l)
+}
+
+// Server is the application side of FastCGI. It accepts connections
+// from web servers (e.g. nginx, or the Handler in this library), and
+// serves the requests as a FastCGI application.
+//
+// Requests are multiplexed: a web server may run concurrent requests
+// over each connection.
+type Server struct {
+
+	// Handler serves requests of the responder role.
+	// If nil, http.DefaultServeMux is used.
+	Handler http.Handler
+
+	// Authorizer serves requests of the authorizer role.
+	// If nil, authorizer requests are rejected with
+	// FCGI_UNKNOWN_ROLE.
+	Authorizer AuthorizerFunc
+
+	// Filter serves requests of the filter role.
+	// If nil, filter requests are rejected with
+	// FCGI_UNKNOWN_ROLE.
+	Filter FilterFunc
+
+	// MaxConns is the maximum number of concurrent connections to
+	// accept. It is reported as FCGI_MAX_CONNS. Zero means no limit.
+	MaxConns int
+
+	// MaxReqs is the maximum number of concurrent requests to accept.
+	// It is reported as FCGI_MAX_REQS. Requests beyond the limit are
+	// rejected with FCGI_OVERLOADED. Zero means no limit.
+	MaxReqs int
+
+	// MaxRequestBuffer is the maximum number of bytes of the request
+	// body (FCGI_STDIN), and of the filter data (FCGI_DATA), buffered
+	// for a request but not yet read by the handler. If exceeded, the
+	// request is ended with FCGI_OVERLOADED, its context is canceled,
+	// and reading the rest fails with ErrRequestTooLarge. If zero,
+	// DefaultMaxRequestBuffer is used. If negative, there is no limit.
+	MaxRequestBuffer int
+
+	// ErrorLog specifies an optional logger for errors accepting
+	// connections. If nil, logging is done via the log package's
+	// standard logger.
+	ErrorLog *log.Logger
+
+	mutex      sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	reqs       int
+	inShutdown bool
+}
+
+func (srv *Server) logf(format string, v ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Serve accepts incoming connections on the listener l, creating
+// a new goroutine for each. The goroutines read requests and then
+// call the handler to reply to them.
+//
+// Serve always returns a non-nil error. After Shutdown or Close,
+// the returned error is ErrServerClosed.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mutex.Lock()
+	if srv.inShutdown {
+		srv.mutex.Unlock()
+		return ErrServerClosed
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	srv.listeners[l] = struct{}{}
+	srv.mutex.Unlock()
+
+	defer func() {
+		srv.mutex.Lock()
+		delete(srv.listeners, l)
+		srv.mutex.Unlock()
+		l.Close()
+	}()
+
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		rwc, err := l.Accept()
+		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				srv.logf("gofast: accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		c := srv.newConn(rwc)
+		if c == nil {
+			rwc.Close()
+			continue
+		}
+		go c.serve()
+	}
+}
+
+// Shutdown gracefully shuts down the server. It closes all listeners,
+// then closes idle connections, and waits for the in-flight requests to
+// complete before closing their connections. New requests on open
+// connections are rejected with FCGI_OVERLOADED.
+//
+// If the context expires before all connections are closed, Shutdown
+// returns the context's error. Otherwise it returns any error from
+// closing the listeners.
+func (srv *Server) Shutdown(ctx context.Context) (err error) {
+	srv.mutex.Lock()
+	srv.inShutdown = true
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	conns := make([]*serverConn, 0, len(srv.conns))
+	for c := range srv.conns {
+		conns = append(conns, c)
+	}
+	srv.mutex.Unlock()
+
+	for _, c := range conns {
+		c.closeIfIdle()
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		srv.mutex.Lock()
+		n := len(srv.conns)
+		srv.mutex.Unlock()
+		if n == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and connections.
+// Handlers of in-flight requests will find their request
+// context canceled.
+func (srv *Server) Close() (err error) {
+	srv.mutex.Lock()
+	srv.inShutdown = true
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	conns := make([]*serverConn, 0, len(srv.conns))
+	for c := range srv.conns {
+		conns = append(conns, c)
+	}
+	srv.mutex.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+	return
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.inShutdown
+}
+
+// servesRole reports if the server has a handler for the role.
+func (srv *Server) servesRole(role Role) bool {
+	switch role {
+	case RoleResponder:
+		return true
+	case RoleAuthorizer:
+		return srv.Authorizer != nil
+	case RoleFilter:
+		return srv.Filter != nil
+	}
+	return false
+}
+
+// maxRequestBuffer returns the effective MaxRequestBuffer,
+// or 0 if there is no limit.
+func (srv *Server) maxRequestBuffer() int {
+	if srv.MaxRequestBuffer == 0 {
+		return DefaultMaxRequestBuffer
+	}
+	if srv.MaxRequestBuffer < 0 {
+		return 0
+	}
+	return srv.MaxRequestBuffer
+}
+
+func (srv *Server) handler() http.Handler {
+	if srv.Handler == nil {
+		return http.DefaultServeMux
+	}
+	return srv.Handler
+}
+
+// newConn tracks a new connection. Returns nil if the
+// connection should be refused.
+func (srv *Server) newConn(rwc net.Conn) *serverConn {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.inShutdown || (srv.MaxConns > 0 && len(srv.conns) >= srv.MaxConns) {
+		return nil
+	}
+	if srv.conns == nil {
+		srv.conns = make(map[*serverConn]struct{})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &serverConn{
+		srv:      srv,
+		rwc:      rwc,
+		conn:     newConn(rwc),
+		ctx:      ctx,
+		cancel:   cancel,
+		requests: make(map[uint16]*serverRequest),
+	}
+	srv.conns[c] = struct{}{}
+	return c
+}
+
+// values returns the FCGI_GET_VALUES_RESULT variables
+// for the given query.
+func (srv *Server) values(query map[string]string) map[string]string {
+	values := make(map[string]string)
+	for name := range query {
+		switch name {
+		case "FCGI_MPXS_CONNS":
+			values[name] = "1"
+		case "FCGI_MAX_CONNS":
+			if srv.MaxConns > 0 {
+				values[name] = fmt.Sprintf("%d", srv.MaxConns)
+			}
+		case "FCGI_MAX_REQS":
+			if srv.MaxReqs > 0 {
+				values[name] = fmt.Sprintf("%d", srv.MaxReqs)
+			}
+		}
+	}
+	return values
+}
+
+// serverConn is a connection from a web server
+type serverConn struct {
+	srv  *Server
+	rwc  net.Conn
+	conn *conn
+
+	// ctx is canceled when the connection is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mutex guards requests
+	mutex    sync.Mutex
+	requests map[uint16]*serverRequest
+
+	closeOnce sync.Once
+}
+
+// serverRequest holds the state of an in-flight request
+type serverRequest struct {
+	id        uint16
+	role      Role
+	keepConn  bool
+	rawParams []byte
+	params    map[string]string
+
+	// stdin and data stream content
+	stdin *streamBuffer
+	data  *streamBuffer
+
+	// serving is set when the request handling has started
+	serving bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mutex guards ended. Records are only written
+	// to the request before it is ended.
+	mutex sync.Mutex
+	ended bool
+}
+
+// serve reads records from the connection until it is closed.
+func (c *serverConn) serve() {
+	defer c.close()
+	r := protocol.NewReader(c.rwc)
+	for {
+		rec, err := r.ReadRecord()
+		if err != nil {
+			return
+		}
+		if err := c.handleRecord(rec); err != nil {
+			return
+		}
+	}
+}
+
+// close closes the connection and cancels all in-flight requests.
+func (c *serverConn) close() {
+	c.closeOnce.Do(func() {
+		c.rwc.Close()
+		c.cancel()
+
+		c.mutex.Lock()
+		for _, req := range c.requests {
+			req.stdin.closeWrite(ErrConnClosed)
+			req.data.closeWrite(ErrConnClosed)
+		}
+		c.mutex.Unlock()
+
+		c.srv.mutex.Lock()
+		delete(c.srv.conns, c)
+		c.srv.mutex.Unlock()
+	})
+}
+
+// closeIfIdle closes the connection if there is no in-flight request.
+func (c *serverConn) closeIfIdle() {
+	c.mutex.Lock()
+	idle := len(c.requests) == 0
+	c.mutex.Unlock()
+	if idle {
+		c.close()
+	}
+}
+
+func (c *serverConn) handleRecord(rec protocol.Record) error {
+
+	// management records
+	if rec.Header.ID == protocol.NullRequestID {
+		switch rec.Header.Type {
+		case typeGetValues:
+			return c.conn.writeGetValuesResult(c.srv.values(readPairs(rec.Content)))
+		default:
+			return c.conn.writeUnknownType(rec.Header.Type)
+		}
+	}
+
+	c.mutex.Lock()
+	req, ok := c.requests[rec.Header.ID]
+	c.mutex.Unlock()
+	if !ok && rec.Header.Type != typeBeginRequest {
+		// The spec says to ignore unknown request IDs.
+		return nil
+	}
+
+	switch rec.Header.Type {
+	case typeBeginRequest:
+		if req != nil {
+			// The server is trying to begin a request with the same ID
+			// as an in-progress request. This is an error.
+			return errors.New("gofast: received ID that is already in-flight")
+		}
+		var br protocol.BeginRequest
+		if err := br.UnmarshalBinary(rec.Content); err != nil {
+			return err
+		}
+		return c.beginRequest(rec.Header.ID, br.Role, br.KeepConn())
+	case typeParams:
+		// NOTE(eds): Technically a key-value pair can straddle the boundary
+		// between two packets. We buffer until we've received all parameters.
+		if len(rec.Content) > 0 {
+			req.rawParams = append(req.rawParams, rec.Content...)
+			return nil
+		}
+		req.params = readPairs(req.rawParams)
+		req.rawParams = nil
+		return nil
+	case typeStdin:
+		if !req.serving {
+			req.serving = true
+			go c.serveRequest(req)
+		}
+		if content := rec.Content; len(content) > 0 {
+			if _, err := req.stdin.Write(content); err != nil {
+				c.rejectTooLarge(req)
+			}
+		} else {
+			req.stdin.closeWrite(io.EOF)
+		}
+		return nil
+	case typeData:
+		if content := rec.Content; len(content) > 0 {
+			if _, err := req.data.Write(content); err != nil {
+				c.rejectTooLarge(req)
+			}
+		} else {
+			req.data.closeWrite(io.EOF)
+		}
+		return nil
+	case typeAbortRequest:
+		req.cancel()
+		req.stdin.closeWrite(ErrRequestAborted)
+		req.data.closeWrite(ErrRequestAborted)
+		c.endRequest(req, 0, StatusRequestComplete)
+		if !req.serving {
+			c.closeIfDone(req)
+		}
+		return nil
+	}
+	return nil
+}
+
+// beginRequest starts tracking a new request, or rejects it
+// with FCGI_END_REQUEST.
+func (c *serverConn) beginRequest(reqID uint16, role Role, keepConn bool) error {
+	status := StatusRequestComplete
+	c.srv.mutex.Lock()
+	switch {
+	case !c.srv.servesRole(role):
+		status = StatusUnknownRole
+	case c.srv.inShutdown:
+		status = StatusOverloaded
+	case c.srv.MaxReqs > 0 && c.srv.reqs >= c.srv.MaxReqs:
+		status = StatusOverloaded
+	default:
+		c.srv.reqs++
+	}
+	c.srv.mutex.Unlock()
+
+	if status != StatusRequestComplete {
+		err := c.conn.writeEndRequest(reqID, 0, status)
+		if err == nil && !keepConn {
+			// connection will close upon return
+			err = io.EOF
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	req := &serverRequest{
+		id:       reqID,
+		role:     role,
+		keepConn: keepConn,
+		stdin:    newStreamBuffer(),
+		data:     newStreamBuffer(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	req.stdin.limit = c.srv.maxRequestBuffer()
+	req.data.limit = req.stdin.limit
+	c.mutex.Lock()
+	c.requests[reqID] = req
+	c.mutex.Unlock()
+	return nil
+}
+
+// rejectTooLarge ends the request with FCGI_OVERLOADED, as its
+// input exceeds the buffer limit. The rest of the input is ignored.
+func (c *serverConn) rejectTooLarge(req *serverRequest) {
+	req.cancel()
+	req.stdin.closeWrite(ErrRequestTooLarge)
+	req.data.closeWrite(ErrRequestTooLarge)
+	c.endRequest(req, 0, StatusOverloaded)
+	if !req.serving {
+		c.closeIfDone(req)
+	}
+}
+
+// writeRecord writes a record of the request, unless
+// the request has been ended.
+func (c *serverConn) writeRecord(req *serverRequest, recType recType, b []byte) error {
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+	if req.ended {
+		return ErrRequestAborted
+	}
+	return c.conn.writeRecord(recType, req.id, b)
+}
+
+// endRequest sends FCGI_END_REQUEST for the request and stops
+// tracking it. Only the first call for a request takes effect.
+func (c *serverConn) endRequest(req *serverRequest, appStatus int, protocolStatus ProtocolStatus) {
+	req.mutex.Lock()
+	if req.ended {
+		req.mutex.Unlock()
+		return
+	}
+	req.ended = true
+	c.conn.writeEndRequest(req.id, appStatus, protocolStatus)
+	req.mutex.Unlock()
+
+	c.mutex.Lock()
+	delete(c.requests, req.id)
+	c.mutex.Unlock()
+
+	c.srv.mutex.Lock()
+	c.srv.reqs--
+	c.srv.mutex.Unlock()
+}
+
+// closeIfDone closes the connection after the given request if
+// the web server did not ask to keep it, or if the server is
+// shutting down and there is no more request on the connection.
+func (c *serverConn) closeIfDone(req *serverRequest) {
+	if !req.keepConn {
+		c.linger()
+		return
+	}
+	if c.srv.shuttingDown() {
+		c.closeIfIdle()
+	}
+}
+
+// linger closes the connection once the web server has finished
+// sending (up to lingerTimeout), instead of closing it right away.
+// Otherwise we'd send a RST, and the web server may lose the end of
+// the response. (golang.org/issue/4183)
+func (c *serverConn) linger() {
+	cw, ok := c.rwc.(interface {
+		CloseWrite() error
+	})
+	if !ok || cw.CloseWrite() != nil {
+		c.close()
+		return
+	}
+
+	// the serve loop discards the rest of the input, and
+	// closes the connection on EOF or on the deadline
+	c.rwc.SetReadDeadline(time.Now().Add(lingerTimeout))
+}
+
+// newStreamWriter returns a buffered writer of the given stream
+// type for the request.
+func (c *serverConn) newStreamWriter(req *serverRequest, recType recType) *bufWriter {
+	s := &requestStreamWriter{c: c, req: req, recType: recType}
+	return &bufWriter{s, bufio.NewWriterSize(s, maxWrite)}
+}
+
+func (c *serverConn) serveRequest(req *serverRequest) {
+	r := newResponse(c, req)
+	httpReq, err := cgi.RequestFromMap(req.params)
+	if err != nil {
+		// there was an error reading the request
+		r.WriteHeader(http.StatusInternalServerError)
+		c.writeRecord(req, typeStderr, []byte(err.Error()))
+	} else {
+		httpReq.Body = req.stdin
+		httpReq = httpReq.WithContext(context.WithValue(req.ctx, paramsContextKey{}, req.params))
+		switch req.role {
+		case RoleAuthorizer:
+			c.srv.serveAuthorizer(r, httpReq)
+		case RoleFilter:
+			c.srv.serveFilter(r, httpReq, req.data)
+		default:
+			c.srv.handler().ServeHTTP(r, httpReq)
+		}
+	}
+
+	// Make sure we serve something even if nothing was written to r
+	r.Write(nil)
+	r.Close()
+	c.endRequest(req, 0, StatusRequestComplete)
+	req.cancel()
+
+	// Discard the rest of the input. The connection is closed
+	// once the web server has finished sending, in the !keepConn
+	// case (see linger).
+	req.stdin.Close()
+	req.data.Close()
+
+	c.closeIfDone(req)
+}
+
+// paramsContextKey is the context key of FastCGI
+// params in the request context
+type paramsContextKey struct{}
+
+// RequestParams returns all the FastCGI params of a request
+// served by Server. Returns nil if the request is not served
+// by Server.
+func RequestParams(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(paramsContextKey{}).(map[string]string)
+	return params
+}
+
+// requestStreamWriter separates a stream of a request into discrete
+// records. It stops writing once the request is ended.
+type requestStreamWriter struct {
+	c       *serverConn
+	req     *serverRequest
+	recType recType
+}
+
+func (w *requestStreamWriter) Write(p []byte) (int, error) {
+	nn := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxWrite {
+			n = maxWrite
+		}
+		if err := w.c.writeRecord(w.req, w.recType, p[:n]); err != nil {
+			return nn, err
+		}
+		nn += n
+		p = p[n:]
+	}
+	return nn, nil
+}
+
+func (w *requestStreamWriter) Close() error {
+	// send empty record to close the stream
+	return w.c.writeRecord(w.req, w.recType, nil)
+}
+
+// response implements http.ResponseWriter.
+type response struct {
+	req            *serverRequest
+	header         http.Header
+	code           int
+	wroteHeader    bool
+	wroteCGIHeader bool
+	w              *bufWriter
+}
+
+func newResponse(c *serverConn, req *serverRequest) *response {
+	return &response{
+		req:    req,
+		header: http.Header{},
+		w:      c.newStreamWriter(req, typeStdout),
+	}
+}
+
+func (r *response) Header() http.Header {
+	return r.header
+}
+
+func (r *response) Write(p []byte) (n int, err error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.wroteCGIHeader {
+		r.writeCGIHeader(p)
+	}
+	return r.w.Write(p)
+}
+
+func (r *response) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.code = code
+	if code == http.StatusNotModified {
+		// Must not have body.
+		r.header.Del("Content-Type")
+		r.header.Del("Content-Length")
+		r.header.Del("Transfer-Encoding")
+	}
+	if r.header.Get("Date") == "" {
+		r.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+}
+
+// writeCGIHeader finalizes the header sent to the client and writes it to the output.
+// p is not written by writeHeader, but is the first chunk of the body
+// that will be written. It is sniffed for a Content-Type if none is
+// set explicitly.
+func (r *response) writeCGIHeader(p []byte) {
+	if r.wroteCGIHeader {
+		return
+	}
+	r.wroteCGIHeader = true
+	fmt.Fprintf(r.w, "Status: %d %s\r\n", r.code, http.StatusText(r.code))
+	if _, hasType := r.header["Content-Type"]; r.code != http.StatusNotModified && !hasType {
+		r.header.Set("Content-Type", http.DetectContentType(p))
+	}
+	r.header.Write(r.w)
+	r.w.WriteString("\r\n")
+	r.w.Flush()
+}
+
+func (r *response) Flush() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.wroteCGIHeader {
+		r.writeCGIHeader(nil)
+	}
+	r.w.Flush()
+}
+
+func (r *response) Close() error {
+	r.Flush()
+	return r.w.Close()
+}
+
+// errBufferFull is returned by streamBuffer.Write beyond the limit
+var errBufferFull = errors.New("gofast: stream buffer full")
+
+// streamBuffer is a pipe for the content of a stream. Writes never
+// block, so a slow reader does not block the other requests
+// multiplexed on the same connection. Instead, writes beyond the
+// limit fail with errBufferFull.
+type streamBuffer struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	limit  int   // maximum bytes buffered, or 0 if unlimited
+	err    error // error to return after buf is drained
+	closed bool  // closed by the reader, discard all writes
+}
+
+func newStreamBuffer() *streamBuffer {
+	b := new(streamBuffer)
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// Read implements io.Reader
+func (b *streamBuffer) Read(p []byte) (n int, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.buf.Len() == 0 && b.err == nil && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if b.buf.Len() > 0 {
+		return b.buf.Read(p)
+	}
+	return 0, b.err
+}
+
+// Write implements io.Writer
+func (b *streamBuffer) Write(p []byte) (n int, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed || b.err != nil {
+		// discard
+		return len(p), nil
+	}
+	if b.limit > 0 && b.buf.Len()+len(p) > b.limit {
+		return 0, errBufferFull
+	}
+	b.buf.Write(p)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// closeWrite ends the stream. Reader will get the given error
+// after the buffered content is read.
+func (b *streamBuffer) closeWrite(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+// Close implements io.Closer. Buffered and further content
+// will be discarded.
+func (b *streamBuffer) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	b.buf = bytes.Buffer{}
+	b.cond.Broadcast()
+	return nil
+}
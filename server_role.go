@@ -0,0 +1,93 @@
+package gofast
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Authorization is the decision of an authorizer application
+// on a request.
+type Authorization struct {
+
+	// Allow the request to proceed to the web server's
+	// own handler.
+	Allow bool
+
+	// Variables are passed to the web server as "Variable-*"
+	// headers of an allowed request. The web server may pass
+	// them on to the protected handler.
+	Variables map[string]string
+
+	// Status of the response for a denied request. Defaults
+	// to http.StatusForbidden.
+	Status int
+
+	// Header and Body of the response for a denied request.
+	// The web server would send them to the client.
+	Header http.Header
+	Body   []byte
+}
+
+// AuthorizerFunc serves requests of the FastCGI authorizer role.
+// The request body, if any, is the FCGI_STDIN stream.
+type AuthorizerFunc func(r *http.Request) Authorization
+
+// FilterData is the FCGI_DATA stream of a filter request.
+type FilterData struct {
+	io.Reader
+
+	// LastMod is the last modification time of the data,
+	// as specified by FCGI_DATA_LAST_MOD. Zero if not given.
+	LastMod time.Time
+
+	// Length is the length of the data, as specified by
+	// FCGI_DATA_LENGTH. -1 if not given.
+	Length int64
+}
+
+// FilterFunc serves requests of the FastCGI filter role.
+// The request body is the FCGI_STDIN stream, and data is the
+// FCGI_DATA stream (e.g. a file) to be filtered.
+//
+// The data stream is only sent after the whole body. A filter
+// may read data without reading the body first.
+type FilterFunc func(w http.ResponseWriter, r *http.Request, data *FilterData)
+
+// serveAuthorizer writes the authorization decision as
+// an authorizer response.
+func (srv *Server) serveAuthorizer(w http.ResponseWriter, r *http.Request) {
+	auth := srv.Authorizer(r)
+	if auth.Allow {
+		for name, value := range auth.Variables {
+			w.Header().Set("Variable-"+name, value)
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	for name, values := range auth.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	if auth.Status == 0 || auth.Status == http.StatusOK {
+		auth.Status = http.StatusForbidden
+	}
+	w.WriteHeader(auth.Status)
+	w.Write(auth.Body)
+}
+
+// serveFilter serves the filter request with the data stream.
+func (srv *Server) serveFilter(w http.ResponseWriter, r *http.Request, data io.Reader) {
+	fd := &FilterData{Reader: data, Length: -1}
+	params := RequestParams(r)
+	if lastMod, err := strconv.ParseInt(params["FCGI_DATA_LAST_MOD"], 10, 64); err == nil {
+		fd.LastMod = time.Unix(lastMod, 0)
+	}
+	if length, err := strconv.ParseInt(params["FCGI_DATA_LENGTH"], 10, 64); err == nil {
+		fd.Length = length
+	}
+	srv.Filter(w, r, fd)
+}
@@ -0,0 +1,135 @@
+package gofast_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/gofast"
+)
+
+func TestServer_authorizer(t *testing.T) {
+	srv := &gofast.Server{
+		Authorizer: func(r *http.Request) gofast.Authorization {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				return gofast.Authorization{
+					Status: http.StatusUnauthorized,
+					Header: http.Header{"Content-Type": {"text/plain"}},
+					Body:   []byte("who are you?"),
+				}
+			}
+			return gofast.Authorization{
+				Allow:     true,
+				Variables: map[string]string{"X-User": "alice"},
+			}
+		},
+	}
+	l, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	authorizer := gofast.NewAuthorizer(
+		gofast.SimpleClientFactory(gofast.SimpleConnFactory("tcp", l.Addr().String())),
+		gofast.Chain(gofast.BasicParamsMap, gofast.MapHeader)(gofast.BasicSession),
+	)
+	h := authorizer.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.Header.Get("X-User"))
+	}))
+
+	// denied
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if want, have := http.StatusUnauthorized, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "who are you?", w.Body.String(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// allowed
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if want, have := http.StatusOK, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "hello alice", w.Body.String(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestServer_filter(t *testing.T) {
+	modTime := time.Now().Add(-10 * time.Second).Truncate(time.Second)
+	vfs := VFS{
+		"index.html": FileEntry{
+			FileInfo: FileInfo{
+				name:    "index.html",
+				size:    11,
+				mode:    0644,
+				modTime: modTime,
+			},
+			content: "hello world",
+		},
+	}
+
+	srv := &gofast.Server{
+		Filter: func(w http.ResponseWriter, r *http.Request, data *gofast.FilterData) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			content, err := ioutil.ReadAll(data)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if want, have := modTime, data.LastMod; !want.Equal(have) {
+				t.Errorf("expected %#v, got %#v", want, have)
+			}
+			if want, have := int64(11), data.Length; want != have {
+				t.Errorf("expected %#v, got %#v", want, have)
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "%s: <%s>", body, content)
+		},
+	}
+	l, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	h := gofast.NewHandler(
+		gofast.NewFilterFS(vfs)(gofast.BasicSession),
+		gofast.SimpleClientFactory(gofast.SimpleConnFactory("tcp", l.Addr().String())),
+	)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/index.html", strings.NewReader("filtered")))
+	if want, have := http.StatusOK, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "filtered: <hello world>", w.Body.String(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestServer_unknownRole(t *testing.T) {
+	srv := &gofast.Server{}
+	l, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	// no Authorizer in the server
+	session := func(client gofast.Client, req *gofast.Request) (*gofast.ResponsePipe, error) {
+		req.Role = gofast.RoleAuthorizer
+		return client.Do(req)
+	}
+	h := gofast.NewHandler(
+		gofast.BasicParamsMap(session),
+		gofast.SimpleClientFactory(gofast.SimpleConnFactory("tcp", l.Addr().String())),
+	)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if want, have := http.StatusInternalServerError, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
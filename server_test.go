@@ -0,0 +1,233 @@
+package gofast_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/gofast"
+)
+
+// newServerApp serves the given handler with gofast.Server
+// on a local TCP listener.
+func newServerApp(t *testing.T, srv *gofast.Server) (l net.Listener, served chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	served = make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+	return
+}
+
+func newServerHandler(l net.Listener, options ...gofast.HandlerOption) gofast.Handler {
+	return gofast.NewHandler(
+		gofast.Chain(
+			gofast.BasicParamsMap,
+			gofast.MapHeader,
+		)(gofast.BasicSession),
+		gofast.SimpleClientFactory(gofast.SimpleConnFactory("tcp", l.Addr().String())),
+		options...,
+	)
+}
+
+func TestServer(t *testing.T) {
+	srv := &gofast.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("X-Foo", r.Header.Get("X-Foo"))
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL.Path,
+				gofast.RequestParams(r)["SERVER_SOFTWARE"], body)
+		}),
+	}
+	l, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	r := httptest.NewRequest("POST", "/hello", strings.NewReader("some body"))
+	r.Header.Set("X-Foo", "bar")
+	w := httptest.NewRecorder()
+	newServerHandler(l).ServeHTTP(w, r)
+
+	if want, have := http.StatusCreated, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "bar", w.Header().Get("X-Foo"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "POST /hello gofast some body", w.Body.String(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestServer_multiplex(t *testing.T) {
+
+	// the handler of /first blocks until /second is served,
+	// so both requests must be in flight on the same connection
+	secondServed := make(chan struct{})
+	srv := &gofast.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/first":
+				select {
+				case <-secondServed:
+				case <-time.After(time.Second):
+					w.WriteHeader(http.StatusGatewayTimeout)
+				}
+			case "/second":
+				defer close(secondServed)
+			}
+			fmt.Fprintf(w, "hello %s", r.URL.Path)
+		}),
+	}
+	l, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	c, err := gofast.SimpleClientFactory(gofast.SimpleConnFactory("tcp", l.Addr().String()))()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	doRequest := func(path string) string {
+		w := httptest.NewRecorder()
+		resp, err := gofast.BasicParamsMap(gofast.BasicSession)(c, gofast.NewRequest(httptest.NewRequest("GET", path, nil)))
+		if err != nil {
+			return err.Error()
+		}
+		if err := resp.WriteTo(w, ioutil.Discard); err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("%d %s", w.Code, w.Body.String())
+	}
+
+	results := make(chan string)
+	go func() {
+		results <- doRequest("/first")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if want, have := "200 hello /second", doRequest("/second"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "200 hello /first", <-results; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestServer_MaxRequestBuffer(t *testing.T) {
+
+	// the handler does not read the body until the
+	// request is ended
+	bodyErr := make(chan error, 1)
+	srv := &gofast.Server{
+		MaxRequestBuffer: 1024,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			_, err := ioutil.ReadAll(r.Body)
+			bodyErr <- err
+		}),
+	}
+	l, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	c, err := gofast.SimpleClientFactory(gofast.SimpleConnFactory("tcp", l.Addr().String()))()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(make([]byte, 64<<10)))
+	resp, err := gofast.BasicParamsMap(gofast.BasicSession)(c, gofast.NewRequest(r))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp.WriteTo(httptest.NewRecorder(), ioutil.Discard)
+	if want, have := gofast.ErrOverloaded, resp.Err(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := gofast.ErrRequestTooLarge, <-bodyErr; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestServer_GetValues(t *testing.T) {
+	srv := &gofast.Server{
+		MaxConns: 10,
+		MaxReqs:  20,
+	}
+	l, _ := newServerApp(t, srv)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := gofast.GetValues(ctx, gofast.SimpleConnFactory("tcp", l.Addr().String()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := (gofast.Values{MaxConns: 10, MaxReqs: 20, MpxsConns: true}), v; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	started, proceed := make(chan struct{}), make(chan struct{})
+	srv := &gofast.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-proceed
+			fmt.Fprintf(w, "done")
+		}),
+	}
+	l, served := newServerApp(t, srv)
+
+	result := make(chan string)
+	go func() {
+		w := httptest.NewRecorder()
+		newServerHandler(l).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		result <- fmt.Sprintf("%d %s", w.Code, w.Body.String())
+	}()
+	<-started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+	if want, have := gofast.ErrServerClosed, <-served; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// the in-flight request should complete before shutdown returns
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before request completed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(proceed)
+	if want, have := "200 done", <-result; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// new connections are refused
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Errorf("expected error dialing closed server")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -74,7 +75,7 @@ func Chain(middlewares ...Middleware) Middleware {
 
 // BasicSession is the default SessionHandler used in the default Handler
 func BasicSession(client Client, req *Request) (*ResponsePipe, error) {
-	return client.Do(req)
+	return client.DoContext(req.Context(), req)
 }
 
 // BasicParamsMap implements Middleware. It maps basic parameters to the
@@ -104,7 +105,7 @@ func BasicParamsMap(inner SessionHandler) SessionHandler {
 
 		isHTTPS := r.TLS != nil
 		if isHTTPS {
-			req.Params["HTTPS"] = "on"
+			req.Params.Set("HTTPS", "on")
 		}
 
 		remoteAddr, remotePort, _ := net.SplitHostPort(r.RemoteAddr)
@@ -126,23 +127,23 @@ func BasicParamsMap(inner SessionHandler) SessionHandler {
 			}
 		}
 		if cl >= 0 {
-			req.Params["CONTENT_LENGTH"] = strconv.FormatInt(cl, 10)
+			req.Params.Set("CONTENT_LENGTH", strconv.FormatInt(cl, 10))
 		}
 
 		// the basic information here
-		req.Params["CONTENT_TYPE"] = r.Header.Get("Content-Type")
-		req.Params["GATEWAY_INTERFACE"] = "CGI/1.1"
-		req.Params["REMOTE_ADDR"] = remoteAddr
-		req.Params["REMOTE_PORT"] = remotePort
-		req.Params["SERVER_PORT"] = serverPort
-		req.Params["SERVER_NAME"] = host
-		req.Params["SERVER_PROTOCOL"] = r.Proto
-		req.Params["SERVER_SOFTWARE"] = "gofast"
-		req.Params["REDIRECT_STATUS"] = "200"
-		req.Params["REQUEST_SCHEME"] = r.URL.Scheme
-		req.Params["REQUEST_METHOD"] = r.Method
-		req.Params["REQUEST_URI"] = r.RequestURI
-		req.Params["QUERY_STRING"] = r.URL.RawQuery
+		req.Params.Set("CONTENT_TYPE", r.Header.Get("Content-Type"))
+		req.Params.Set("GATEWAY_INTERFACE", "CGI/1.1")
+		req.Params.Set("REMOTE_ADDR", remoteAddr)
+		req.Params.Set("REMOTE_PORT", remotePort)
+		req.Params.Set("SERVER_PORT", serverPort)
+		req.Params.Set("SERVER_NAME", host)
+		req.Params.Set("SERVER_PROTOCOL", r.Proto)
+		req.Params.Set("SERVER_SOFTWARE", "gofast")
+		req.Params.Set("REDIRECT_STATUS", "200")
+		req.Params.Set("REQUEST_SCHEME", r.URL.Scheme)
+		req.Params.Set("REQUEST_METHOD", r.Method)
+		req.Params.Set("REQUEST_URI", r.RequestURI)
+		req.Params.Set("QUERY_STRING", r.URL.RawQuery)
 
 		return inner(client, req)
 	}
@@ -156,7 +157,7 @@ func MapRemoteHost(inner SessionHandler) SessionHandler {
 		remoteAddr, _, _ := net.SplitHostPort(r.RemoteAddr)
 		names, _ := net.LookupAddr(remoteAddr)
 		if len(names) > 0 {
-			req.Params["REMOTE_HOST"] = strings.TrimRight(names[0], ".")
+			req.Params.Set("REMOTE_HOST", strings.TrimRight(names[0], "."))
 		}
 		return inner(client, req)
 	}
@@ -171,10 +172,10 @@ func MapRemoteHost(inner SessionHandler) SessionHandler {
 //	SCRIPT_NAME
 func FilterAuthReqParams(inner SessionHandler) SessionHandler {
 	return func(client Client, req *Request) (*ResponsePipe, error) {
-		delete(req.Params, "CONTENT_LENGTH")
-		delete(req.Params, "PATH_INFO")
-		delete(req.Params, "PATH_TRANSLATED")
-		delete(req.Params, "SCRIPT_NAME")
+		req.Params.Del("CONTENT_LENGTH")
+		req.Params.Del("PATH_INFO")
+		req.Params.Del("PATH_TRANSLATED")
+		req.Params.Del("SCRIPT_NAME")
 		return inner(client, req)
 	}
 }
@@ -229,16 +230,16 @@ func (fs *FileSystemRouter) Router() Middleware {
 				fastcgiScriptName = path.Join(fastcgiScriptName, "index.php")
 			}
 
-			req.Params["PATH_INFO"] = fastcgiPathInfo
-			req.Params["PATH_TRANSLATED"] = filepath.Join(docroot, fastcgiPathInfo)
-			req.Params["SCRIPT_NAME"] = fastcgiScriptName
-			req.Params["SCRIPT_FILENAME"] = filepath.Join(docroot, fastcgiScriptName)
-			req.Params["DOCUMENT_URI"] = r.URL.Path
-			req.Params["DOCUMENT_ROOT"] = docroot
+			req.Params.Set("PATH_INFO", fastcgiPathInfo)
+			req.Params.Set("PATH_TRANSLATED", filepath.Join(docroot, fastcgiPathInfo))
+			req.Params.Set("SCRIPT_NAME", fastcgiScriptName)
+			req.Params.Set("SCRIPT_FILENAME", filepath.Join(docroot, fastcgiScriptName))
+			req.Params.Set("DOCUMENT_URI", r.URL.Path)
+			req.Params.Set("DOCUMENT_ROOT", docroot)
 
 			// check if the script filename is within docroot.
 			// triggers error if not.
-			if !strings.HasPrefix(req.Params["SCRIPT_FILENAME"], docroot) {
+			if !strings.HasPrefix(req.Params.Get("SCRIPT_FILENAME"), docroot) {
 				err := fmt.Errorf("error: access path outside of filesystem docroot")
 				return nil, err
 			}
@@ -265,11 +266,18 @@ func MapHeader(inner SessionHandler) SessionHandler {
 		// Explicitly map raw host field because golang core library seems to remove
 		// the header field.
 		if r.Host != "" {
-			req.Params["HTTP_HOST"] = r.Host
+			req.Params.Set("HTTP_HOST", r.Host)
 		}
 
-		// http header
-		for k, v := range r.Header {
+		// http header, in the order of field names
+		// so the params are deterministic
+		keys := make([]string, 0, len(r.Header))
+		for k := range r.Header {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := r.Header[k]
 			formattedKey := strings.Replace(strings.ToUpper(k), "-", "_", -1)
 			if formattedKey == "CONTENT_TYPE" || formattedKey == "CONTENT_LENGTH" {
 				continue
@@ -290,7 +298,7 @@ func MapHeader(inner SessionHandler) SessionHandler {
 				//   forwarding a message.
 				value = strings.Join(v, ",")
 			}
-			req.Params[key] = value
+			req.Params.Set(key, value)
 		}
 
 		return inner(client, req)
@@ -314,11 +322,11 @@ func MapEndpoint(endpointFile string) Middleware {
 	return func(inner SessionHandler) SessionHandler {
 		return func(client Client, req *Request) (*ResponsePipe, error) {
 			r := req.Raw
-			req.Params["REQUEST_URI"] = r.URL.RequestURI()
-			req.Params["SCRIPT_NAME"] = webpath
-			req.Params["SCRIPT_FILENAME"] = endpointFile
-			req.Params["DOCUMENT_URI"] = r.URL.Path
-			req.Params["DOCUMENT_ROOT"] = dir
+			req.Params.Set("REQUEST_URI", r.URL.RequestURI())
+			req.Params.Set("SCRIPT_NAME", webpath)
+			req.Params.Set("SCRIPT_FILENAME", endpointFile)
+			req.Params.Set("DOCUMENT_URI", r.URL.Path)
+			req.Params.Set("DOCUMENT_ROOT", dir)
 			return inner(client, req)
 		}
 	}
@@ -350,9 +358,9 @@ func MapFilterRequest(fs http.FileSystem) Middleware {
 				fastcgiScriptName, fastcgiPathInfo = matches[1], matches[2]
 			}
 
-			req.Params["PATH_INFO"] = fastcgiPathInfo
-			req.Params["SCRIPT_NAME"] = fastcgiScriptName
-			req.Params["DOCUMENT_URI"] = r.URL.Path
+			req.Params.Set("PATH_INFO", fastcgiPathInfo)
+			req.Params.Set("SCRIPT_NAME", fastcgiScriptName)
+			req.Params.Set("DOCUMENT_URI", r.URL.Path)
 
 			// handle directory index
 			urlPath := r.URL.Path
@@ -373,8 +381,8 @@ func MapFilterRequest(fs http.FileSystem) Middleware {
 				err = fmt.Errorf("cannot stat file: %s", err)
 				return nil, err
 			}
-			req.Params["FCGI_DATA_LAST_MOD"] = fmt.Sprintf("%d", s.ModTime().Unix())
-			req.Params["FCGI_DATA_LENGTH"] = fmt.Sprintf("%d", s.Size())
+			req.Params.Set("FCGI_DATA_LAST_MOD", fmt.Sprintf("%d", s.ModTime().Unix()))
+			req.Params.Set("FCGI_DATA_LENGTH", fmt.Sprintf("%d", s.Size()))
 
 			// use the file as FCGI_DATA in request
 			req.Data = f
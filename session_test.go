@@ -99,7 +99,7 @@ func TestMapRemoteHost(t *testing.T) {
 		return
 	})
 	inner := func(client gofast.Client, req *gofast.Request) (resp *gofast.ResponsePipe, err error) {
-		if remoteHost, ok := req.Params["REMOTE_HOST"]; !ok {
+		if remoteHost, ok := req.Params.Lookup("REMOTE_HOST"); !ok {
 			t.Error("filter request requires param FCGI_DATA_LAST_MOD")
 		} else if want, have := "dns.google", remoteHost; want != have {
 			t.Errorf("expected %#v, got %#v", want, have)
@@ -147,7 +147,7 @@ func TestMapFilterRequest(t *testing.T) {
 			t.Errorf("expected: %#v, got: %#v", want, have)
 		}
 
-		if lastModStr, ok := req.Params["FCGI_DATA_LAST_MOD"]; !ok {
+		if lastModStr, ok := req.Params.Lookup("FCGI_DATA_LAST_MOD"); !ok {
 			t.Error("filter request requires param FCGI_DATA_LAST_MOD")
 		} else if lastMod, err := strconv.ParseInt(lastModStr, 10, 32); err != nil {
 			t.Errorf("invalid parsing FCGI_DATA_LAST_MOD (%s)", err)
@@ -155,9 +155,9 @@ func TestMapFilterRequest(t *testing.T) {
 			t.Errorf("expected: %#v, got: %#v", want, have)
 		}
 
-		if _, ok := req.Params["FCGI_DATA_LENGTH"]; !ok {
+		if _, ok := req.Params.Lookup("FCGI_DATA_LENGTH"); !ok {
 			t.Error("filter request requires param FCGI_DATA_LENGTH")
-		} else if _, err = strconv.ParseInt(req.Params["FCGI_DATA_LENGTH"], 10, 32); err != nil {
+		} else if _, err = strconv.ParseInt(req.Params.Get("FCGI_DATA_LENGTH"), 10, 32); err != nil {
 			t.Errorf("invalid parsing FCGI_DATA_LENGTH (%s)", err)
 		}
 		return
@@ -191,7 +191,7 @@ func TestFileSystemRouter_PathTraversal(t *testing.T) {
 		gofast.BasicParamsMap,
 		fs.Router(),
 	)(func(client gofast.Client, req *gofast.Request) (resp *gofast.ResponsePipe, err error) {
-		t.Logf("SCRIPT_FILENAME: %s", req.Params["SCRIPT_FILENAME"])
+		t.Logf("SCRIPT_FILENAME: %s", req.Params.Get("SCRIPT_FILENAME"))
 		return
 	})
 
@@ -223,7 +223,7 @@ func TestFileSystemRouter_DirectoryPath(t *testing.T) {
 		gofast.BasicParamsMap,
 		fs.Router(),
 	)(func(client gofast.Client, req *gofast.Request) (resp *gofast.ResponsePipe, err error) {
-		err = fmt.Errorf("SCRIPT_FILENAME=%s", req.Params["SCRIPT_FILENAME"])
+		err = fmt.Errorf("SCRIPT_FILENAME=%s", req.Params.Get("SCRIPT_FILENAME"))
 		return
 	})
 
@@ -0,0 +1,73 @@
+package gofast
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// Values holds the variables reported by a FastCGI application
+// through FCGI_GET_VALUES_RESULT.
+//
+// Variables not reported by the application are left as zero
+// value.
+type Values struct {
+	// MaxConns is FCGI_MAX_CONNS, the maximum number of concurrent
+	// transport connections the application will accept.
+	MaxConns int
+
+	// MaxReqs is FCGI_MAX_REQS, the maximum number of concurrent
+	// requests the application will accept.
+	MaxReqs int
+
+	// MpxsConns is FCGI_MPXS_CONNS, true if the application
+	// multiplexes connections (i.e. handle concurrent requests
+	// over each connection).
+	MpxsConns bool
+}
+
+// parseValues parses the name-value pairs in a FCGI_GET_VALUES_RESULT
+// record into Values.
+func parseValues(pairs map[string]string) (v Values, err error) {
+	if s, ok := pairs["FCGI_MAX_CONNS"]; ok {
+		if v.MaxConns, err = strconv.Atoi(s); err != nil {
+			err = fmt.Errorf("gofast: invalid FCGI_MAX_CONNS %q", s)
+			return
+		}
+	}
+	if s, ok := pairs["FCGI_MAX_REQS"]; ok {
+		if v.MaxReqs, err = strconv.Atoi(s); err != nil {
+			err = fmt.Errorf("gofast: invalid FCGI_MAX_REQS %q", s)
+			return
+		}
+	}
+	if s, ok := pairs["FCGI_MPXS_CONNS"]; ok {
+		switch s {
+		case "0":
+			v.MpxsConns = false
+		case "1":
+			v.MpxsConns = true
+		default:
+			err = fmt.Errorf("gofast: invalid FCGI_MPXS_CONNS %q", s)
+			return
+		}
+	}
+	return
+}
+
+// GetValues connects to the FastCGI application with the given
+// ConnFactory, then query FCGI_MAX_CONNS, FCGI_MAX_REQS and
+// FCGI_MPXS_CONNS with a FCGI_GET_VALUES record.
+//
+// It can be used to size a ClientPool, or to check if an address
+// really serves FastCGI. The context should have a deadline as
+// some applications never answer to the query.
+func GetValues(ctx context.Context, connFactory ConnFactory) (v Values, err error) {
+	conn, err := connFactory()
+	if err != nil {
+		return
+	}
+	c := newClient(conn)
+	defer c.Close()
+	return c.getValues(ctx)
+}
@@ -0,0 +1,113 @@
+package gofast_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yookoala/gofast"
+)
+
+// newValuesApp creates a dummy FastCGI application that answers
+// every FCGI_GET_VALUES record with the given raw pairs content.
+func newValuesApp(t *testing.T, content []byte) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				h := make([]byte, 8)
+				for {
+					if _, err := io.ReadFull(conn, h); err != nil {
+						return
+					}
+					body := make([]byte, int(binary.BigEndian.Uint16(h[4:]))+int(h[6]))
+					if _, err := io.ReadFull(conn, body); err != nil {
+						return
+					}
+					res := []byte{1, 10, 0, 0, 0, 0, 0, 0}
+					binary.BigEndian.PutUint16(res[4:], uint16(len(content)))
+					conn.Write(append(res, content...))
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestGetValues(t *testing.T) {
+	l := newValuesApp(t, []byte(
+		"\x0e\x03FCGI_MAX_CONNS100"+
+			"\x0d\x02FCGI_MAX_REQS50"+
+			"\x0f\x01FCGI_MPXS_CONNS0",
+	))
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := gofast.GetValues(ctx, gofast.SimpleConnFactory("tcp", l.Addr().String()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := (gofast.Values{MaxConns: 100, MaxReqs: 50, MpxsConns: false}), v; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestGetValues_invalid(t *testing.T) {
+	l := newValuesApp(t, []byte("\x0f\x03FCGI_MPXS_CONNSyes"))
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := gofast.GetValues(ctx, gofast.SimpleConnFactory("tcp", l.Addr().String()))
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if want, have := `gofast: invalid FCGI_MPXS_CONNS "yes"`, err.Error(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestGetValues_netHTTPFCGI(t *testing.T) {
+	p, err := newAppServer("values.test.sock", func(w http.ResponseWriter, r *http.Request) {})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := gofast.GetValues(ctx, gofast.SimpleConnFactory(p.Network(), p.Address()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := true, v.MpxsConns; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestGetValues_notFastCGI(t *testing.T) {
+	// a HTTP server does not speak FastCGI
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := gofast.GetValues(ctx, gofast.SimpleConnFactory("tcp", s.Listener.Addr().String()))
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}